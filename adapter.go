@@ -0,0 +1,107 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"encoding/json"
+)
+
+// ClusterMessageType identifies who a ClusterMessage is addressed to.
+type ClusterMessageType string
+
+const (
+	ClusterBroadcast   ClusterMessageType = "broadcast"
+	ClusterRoom        ClusterMessageType = "room"
+	ClusterRoomChannel ClusterMessageType = "room_channel"
+	ClusterUser        ClusterMessageType = "user"
+	// ClusterPresence carries the presence of users on the publishing node
+	// rather than an emit. Users of a node that stops without its
+	// connections closing stay present on the others.
+	ClusterPresence ClusterMessageType = "presence"
+)
+
+// ClusterMessage is an emit or presence update relayed between the nodes of a cluster.
+type ClusterMessage struct {
+	// Node is the ID of the node that published the message.
+	Node     string             `json:"node"`
+	Type     ClusterMessageType `json:"type"`
+	Room     string             `json:"room,omitempty"`
+	Channel  string             `json:"channel,omitempty"`
+	Username string             `json:"username,omitempty"`
+	Exclude  string             `json:"exclude,omitempty"`
+	Event    string             `json:"event"`
+	Data     json.RawMessage    `json:"data,omitempty"`
+}
+
+// Adapter relays broadcasts, room emits, user emits and presence to the other
+// nodes of a cluster so they reach connections held by other processes.
+type Adapter interface {
+	// Publish sends msg to the other nodes.
+	Publish(msg *ClusterMessage) error
+	// Subscribe sets the function called for messages published by other nodes.
+	Subscribe(handler func(msg *ClusterMessage))
+	// Close disconnects the adapter from the cluster.
+	Close() error
+}
+
+// publish relays an emit to the rest of the cluster.
+func (s *Sockets) publish(msg *ClusterMessage, data interface{}) {
+	if s.config.Adapter == nil {
+		return
+	}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		s.config.Logger.Error("failed to encode cluster message", "event", msg.Event, "error", err)
+		return
+	}
+	msg.Node = s.nodeID
+	msg.Data = payload
+
+	if err := s.config.Adapter.Publish(msg); err != nil {
+		s.config.Logger.Error("failed to publish cluster message", "event", msg.Event, "error", err)
+	}
+}
+
+// handleClusterMessage delivers a message published by another node to the
+// matching local connections.
+func (s *Sockets) handleClusterMessage(msg *ClusterMessage) {
+	if msg.Node == s.nodeID {
+		return
+	}
+
+	switch msg.Type {
+	case ClusterBroadcast:
+		s.broadcastLocal(msg.Event, msg.Data)
+	case ClusterRoom:
+		s.broadcastToRoomLocal(msg.Room, msg.Exclude, msg.Event, msg.Data)
+	case ClusterRoomChannel:
+		s.broadcastToRoomChannelLocal(msg.Room, msg.Channel, msg.Exclude, msg.Event, msg.Data)
+	case ClusterUser:
+		s.emitToUserLocal(msg.Username, msg.Event, msg.Data)
+	case ClusterPresence:
+		s.handleClusterPresence(msg)
+	default:
+		s.config.Logger.Warn("ignoring cluster message of unknown type", "type", msg.Type, "node", msg.Node)
+	}
+}
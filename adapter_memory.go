@@ -0,0 +1,110 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"errors"
+	"sync"
+)
+
+// MemoryBus connects MemoryAdapters within a single process. It lets several
+// Sockets instances act as a cluster, which is mostly useful in tests.
+type MemoryBus struct {
+	adapters []*MemoryAdapter
+	sync.RWMutex
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{}
+}
+
+// Adapter returns a new adapter attached to the bus.
+func (b *MemoryBus) Adapter() *MemoryAdapter {
+	a := &MemoryAdapter{bus: b}
+
+	b.Lock()
+	defer b.Unlock()
+	b.adapters = append(b.adapters, a)
+	return a
+}
+
+func (b *MemoryBus) remove(a *MemoryAdapter) {
+	b.Lock()
+	defer b.Unlock()
+	for i, adapter := range b.adapters {
+		if adapter == a {
+			b.adapters = append(b.adapters[:i], b.adapters[i+1:]...)
+			return
+		}
+	}
+}
+
+// MemoryAdapter is an Adapter delivering messages to the other adapters of its MemoryBus.
+type MemoryAdapter struct {
+	bus     *MemoryBus
+	handler func(msg *ClusterMessage)
+	closed  bool
+	sync.RWMutex
+}
+
+func (a *MemoryAdapter) Publish(msg *ClusterMessage) error {
+	a.RLock()
+	closed := a.closed
+	a.RUnlock()
+	if closed {
+		return errors.New("adapter is closed")
+	}
+
+	a.bus.RLock()
+	adapters := append([]*MemoryAdapter(nil), a.bus.adapters...)
+	a.bus.RUnlock()
+
+	for _, adapter := range adapters {
+		if adapter == a {
+			continue
+		}
+		adapter.RLock()
+		handler := adapter.handler
+		adapter.RUnlock()
+		if handler != nil {
+			handler(msg)
+		}
+	}
+	return nil
+}
+
+func (a *MemoryAdapter) Subscribe(handler func(msg *ClusterMessage)) {
+	a.Lock()
+	defer a.Unlock()
+	a.handler = handler
+}
+
+func (a *MemoryAdapter) Close() error {
+	a.Lock()
+	a.closed = true
+	a.handler = nil
+	a.Unlock()
+
+	a.bus.remove(a)
+	return nil
+}
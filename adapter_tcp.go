@@ -0,0 +1,408 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/syleron/sockets/common"
+)
+
+// meshWriteWait is the time allowed to write a message to a peer.
+const meshWriteWait = 5 * time.Second
+
+// meshLogInterval is the minimum time between repeated logs about a peer.
+const meshLogInterval = time.Minute
+
+type TCPMeshConfig struct {
+	// Address to accept messages from peers on, e.g. ":7946".
+	ListenAddr string
+	// Addresses of the other nodes of the cluster.
+	Peers []string
+	// Used to both listen and dial when set. Without it the listener must
+	// only be reachable from a trusted network.
+	TLSConfig *tls.Config
+	// Delay between attempts to reach a peer.
+	RedialInterval time.Duration
+	// Maximum size of a single message accepted from a peer.
+	MaxMessageSize int
+	// Number of messages waiting to be written to a single peer. Messages for
+	// a peer whose queue is full are dropped.
+	QueueSize int
+	// Receives the adapter's logs, nothing is logged when nil.
+	Logger common.Logger
+	// Counts the messages dropped for peers.
+	Metrics Metrics
+}
+
+// TCPMeshAdapter is an Adapter connecting every node directly to every other
+// node over TCP, so no external message broker is needed. Each node dials
+// all of its peers and sends its messages as newline delimited JSON.
+type TCPMeshAdapter struct {
+	config    TCPMeshConfig
+	listener  net.Listener
+	peers     []*meshPeer
+	handler   func(msg *ClusterMessage)
+	inbound   map[net.Conn]bool
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+	sync.RWMutex
+}
+
+// meshPeer is the outgoing connection to a single peer. Messages are queued
+// and written by the peer's own goroutine, so a slow peer never blocks Publish.
+type meshPeer struct {
+	addr      string
+	queue     chan []byte
+	connected int32
+	conn      net.Conn
+	closed    bool
+	// Limit how often drops and failed dials are logged
+	dropLog logLimiter
+	dialLog logLimiter
+	sync.Mutex
+}
+
+// NewTCPMeshAdapter starts listening on config.ListenAddr and connecting to
+// config.Peers. Peers that can't be reached are retried in the background.
+func NewTCPMeshAdapter(config TCPMeshConfig) (*TCPMeshAdapter, error) {
+	if config.RedialInterval == 0 {
+		config.RedialInterval = time.Second
+	}
+	if config.MaxMessageSize == 0 {
+		config.MaxMessageSize = 1 << 20
+	}
+	if config.QueueSize == 0 {
+		config.QueueSize = 1024
+	}
+	if config.Logger == nil {
+		config.Logger = common.NopLogger
+	}
+	if config.Metrics == nil {
+		config.Metrics = noopMetrics{}
+	}
+
+	var listener net.Listener
+	var err error
+	if config.TLSConfig != nil {
+		listener, err = tls.Listen("tcp", config.ListenAddr, config.TLSConfig)
+	} else {
+		listener, err = net.Listen("tcp", config.ListenAddr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for peers: %w", err)
+	}
+
+	a := &TCPMeshAdapter{
+		config:   config,
+		listener: listener,
+		inbound:  make(map[net.Conn]bool),
+		done:     make(chan struct{}),
+	}
+
+	a.wg.Add(1)
+	go a.accept()
+
+	for _, addr := range config.Peers {
+		peer := &meshPeer{
+			addr:    addr,
+			queue:   make(chan []byte, config.QueueSize),
+			dropLog: logLimiter{interval: meshLogInterval},
+			dialLog: logLimiter{interval: meshLogInterval},
+		}
+		a.peers = append(a.peers, peer)
+		a.wg.Add(1)
+		go a.maintain(peer)
+	}
+
+	return a, nil
+}
+
+// Addr returns the address the adapter listens on.
+func (a *TCPMeshAdapter) Addr() net.Addr {
+	return a.listener.Addr()
+}
+
+// Publish queues msg for every peer without waiting for it to be written.
+// Peers that are unreachable or whose queue is full miss the message, which
+// is reported to Metrics.
+func (a *TCPMeshAdapter) Publish(msg *ClusterMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	for _, peer := range a.peers {
+		reason := peer.enqueue(data)
+		if reason == "" {
+			continue
+		}
+		a.config.Metrics.MessageDropped(msg.Event, reason)
+		if ok, suppressed := peer.dropLog.allow(); ok {
+			a.config.Logger.Warn("dropping cluster messages for peer", "peer", peer.addr, "reason", reason, "suppressed", suppressed)
+		}
+	}
+	return nil
+}
+
+func (a *TCPMeshAdapter) Subscribe(handler func(msg *ClusterMessage)) {
+	a.Lock()
+	defer a.Unlock()
+	a.handler = handler
+}
+
+func (a *TCPMeshAdapter) Close() error {
+	var err error
+	a.closeOnce.Do(func() {
+		close(a.done)
+		err = a.listener.Close()
+
+		for _, peer := range a.peers {
+			peer.close()
+		}
+
+		a.Lock()
+		for conn := range a.inbound {
+			conn.Close()
+		}
+		a.Unlock()
+
+		a.wg.Wait()
+	})
+	return err
+}
+
+func (a *TCPMeshAdapter) accept() {
+	defer a.wg.Done()
+
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			select {
+			case <-a.done:
+				return
+			default:
+			}
+			a.config.Logger.Error("failed to accept peer connection", "error", err)
+			time.Sleep(a.config.RedialInterval)
+			continue
+		}
+
+		a.Lock()
+		a.inbound[conn] = true
+		a.Unlock()
+
+		a.wg.Add(1)
+		go a.serve(conn)
+	}
+}
+
+// serve reads the messages published by a single peer.
+func (a *TCPMeshAdapter) serve(conn net.Conn) {
+	defer a.wg.Done()
+	defer func() {
+		a.Lock()
+		delete(a.inbound, conn)
+		a.Unlock()
+		conn.Close()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 64*1024), a.config.MaxMessageSize)
+	for scanner.Scan() {
+		var msg ClusterMessage
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			a.config.Logger.Warn("dropping malformed message from peer", "peer", conn.RemoteAddr().String(), "error", err)
+			continue
+		}
+
+		a.RLock()
+		handler := a.handler
+		a.RUnlock()
+		if handler != nil {
+			handler(&msg)
+		}
+	}
+	select {
+	case <-a.done:
+		return
+	default:
+	}
+	if err := scanner.Err(); err != nil {
+		a.config.Logger.Warn("lost connection from peer", "peer", conn.RemoteAddr().String(), "error", err)
+	}
+}
+
+// maintain keeps the connection to a peer open, redialing whenever it drops,
+// and writes the peer's queued messages.
+func (a *TCPMeshAdapter) maintain(peer *meshPeer) {
+	defer a.wg.Done()
+
+	for {
+		conn, err := a.dial(peer.addr)
+		if err != nil {
+			if ok, suppressed := peer.dialLog.allow(); ok {
+				a.config.Logger.Warn("failed to reach peer", "peer", peer.addr, "suppressed", suppressed, "error", err)
+			}
+		} else {
+			if !peer.reset(conn) {
+				return
+			}
+			a.config.Logger.Debug("connected to peer", "peer", peer.addr)
+			err := a.pump(peer, conn)
+			if !peer.reset(nil) {
+				return
+			}
+			if ok, suppressed := peer.dialLog.allow(); ok {
+				a.config.Logger.Warn("lost connection to peer", "peer", peer.addr, "suppressed", suppressed, "error", err)
+			}
+		}
+
+		select {
+		case <-a.done:
+			return
+		case <-time.After(a.config.RedialInterval):
+		}
+	}
+}
+
+// pump writes the peer's queued messages to conn until writing fails, the
+// peer hangs up or the adapter is closed.
+func (a *TCPMeshAdapter) pump(peer *meshPeer, conn net.Conn) error {
+	defer conn.Close()
+
+	lost := make(chan struct{})
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		// Peers never write back, so this only returns once the connection is gone
+		io.Copy(io.Discard, conn)
+		close(lost)
+	}()
+
+	for {
+		select {
+		case data := <-peer.queue:
+			conn.SetWriteDeadline(time.Now().Add(meshWriteWait))
+			if _, err := conn.Write(data); err != nil {
+				return err
+			}
+		case <-lost:
+			return errors.New("connection closed")
+		case <-a.done:
+			return nil
+		}
+	}
+}
+
+func (a *TCPMeshAdapter) dial(addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: meshWriteWait}
+	if a.config.TLSConfig != nil {
+		return tls.DialWithDialer(dialer, "tcp", addr, a.config.TLSConfig)
+	}
+	return dialer.Dial("tcp", addr)
+}
+
+// reset replaces the peer's connection, closing the previous one. It returns
+// false, closing conn, once the peer has been closed.
+func (p *meshPeer) reset(conn net.Conn) bool {
+	p.Lock()
+	defer p.Unlock()
+	if p.conn != nil && p.conn != conn {
+		p.conn.Close()
+	}
+	if p.closed {
+		if conn != nil {
+			conn.Close()
+		}
+		p.conn = nil
+		atomic.StoreInt32(&p.connected, 0)
+		return false
+	}
+	p.conn = conn
+	if conn != nil {
+		atomic.StoreInt32(&p.connected, 1)
+	} else {
+		atomic.StoreInt32(&p.connected, 0)
+	}
+	return true
+}
+
+func (p *meshPeer) close() {
+	p.Lock()
+	defer p.Unlock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+}
+
+// enqueue queues data for the peer. It returns the reason data was dropped,
+// or an empty string.
+func (p *meshPeer) enqueue(data []byte) string {
+	if atomic.LoadInt32(&p.connected) == 0 {
+		return DropPeerUnreachable
+	}
+	select {
+	case p.queue <- data:
+		return ""
+	default:
+		return DropPeerQueueFull
+	}
+}
+
+// logLimiter lets a log through at most once per interval, counting the logs
+// it suppressed in between.
+type logLimiter struct {
+	interval   time.Duration
+	last       time.Time
+	suppressed int
+	sync.Mutex
+}
+
+// allow reports whether to log now, along with the number of logs suppressed
+// since the last one.
+func (l *logLimiter) allow() (bool, int) {
+	l.Lock()
+	defer l.Unlock()
+	if now := time.Now(); now.Sub(l.last) >= l.interval {
+		suppressed := l.suppressed
+		l.last = now
+		l.suppressed = 0
+		return true, suppressed
+	}
+	l.suppressed++
+	return false, 0
+}
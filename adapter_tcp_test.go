@@ -0,0 +1,175 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dropMetrics counts the messages dropped by reason.
+type dropMetrics struct {
+	noopMetrics
+	dropped map[string]int
+	sync.Mutex
+}
+
+func (m *dropMetrics) MessageDropped(event, reason string) {
+	m.Lock()
+	defer m.Unlock()
+	if m.dropped == nil {
+		m.dropped = make(map[string]int)
+	}
+	m.dropped[reason]++
+}
+
+func (m *dropMetrics) count(reason string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.dropped[reason]
+}
+
+func newTestMesh(t *testing.T, config TCPMeshConfig) *TCPMeshAdapter {
+	t.Helper()
+	if config.ListenAddr == "" {
+		config.ListenAddr = "127.0.0.1:0"
+	}
+	if config.RedialInterval == 0 {
+		config.RedialInterval = 10 * time.Millisecond
+	}
+	a, err := NewTCPMeshAdapter(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { a.Close() })
+	return a
+}
+
+func waitConnected(t *testing.T, peer *meshPeer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&peer.connected) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("peer %s never connected", peer.addr)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestTCPMeshPublish(t *testing.T) {
+	received := make(chan *ClusterMessage, 1)
+	a := newTestMesh(t, TCPMeshConfig{})
+	a.Subscribe(func(msg *ClusterMessage) { received <- msg })
+
+	b := newTestMesh(t, TCPMeshConfig{Peers: []string{a.Addr().String()}})
+	waitConnected(t, b.peers[0])
+
+	if err := b.Publish(&ClusterMessage{Node: "b", Type: ClusterBroadcast, Event: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg.Node != "b" || msg.Event != "hello" {
+			t.Fatalf("received %+v", msg)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+}
+
+func TestTCPMeshSlowPeer(t *testing.T) {
+	// The peer accepts connections but never reads from them
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	metrics := &dropMetrics{}
+	a := newTestMesh(t, TCPMeshConfig{Peers: []string{listener.Addr().String()}, QueueSize: 4, Metrics: metrics})
+	waitConnected(t, a.peers[0])
+
+	data := []byte(`"` + strings.Repeat("x", 64*1024) + `"`)
+	start := time.Now()
+	for i := 0; i < 200; i++ {
+		if err := a.Publish(&ClusterMessage{Type: ClusterBroadcast, Event: "fill", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= meshWriteWait {
+		t.Fatalf("publishing to a slow peer took %v", elapsed)
+	}
+	if metrics.count(DropPeerQueueFull) == 0 {
+		t.Fatal("no messages were dropped for the full queue")
+	}
+}
+
+func TestTCPMeshUnreachablePeer(t *testing.T) {
+	// Reserve an address nothing listens on
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	metrics := &dropMetrics{}
+	a := newTestMesh(t, TCPMeshConfig{Peers: []string{addr}, Metrics: metrics})
+	if err := a.Publish(&ClusterMessage{Type: ClusterBroadcast, Event: "lost"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := metrics.count(DropPeerUnreachable); got != 1 {
+		t.Fatalf("dropped %d messages for the unreachable peer, want 1", got)
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	l := logLimiter{interval: time.Hour}
+	if ok, _ := l.allow(); !ok {
+		t.Fatal("first log was suppressed")
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow(); ok {
+			t.Fatal("repeated log was allowed")
+		}
+	}
+
+	l.last = time.Now().Add(-time.Hour)
+	ok, suppressed := l.allow()
+	if !ok || suppressed != 3 {
+		t.Fatalf("allow() = %v, %d after the interval, want true, 3", ok, suppressed)
+	}
+}
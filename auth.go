@@ -0,0 +1,310 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/syleron/sockets/common"
+)
+
+var (
+	// ErrUnauthorized is returned by HandleConnection when the Authenticator
+	// rejected the request.
+	ErrUnauthorized = errors.New("sockets: unauthorized")
+	// ErrMissingToken is returned by JWTAuthenticator when the request carries
+	// no token.
+	ErrMissingToken = errors.New("missing token")
+)
+
+// Identity is the authenticated user behind a connection.
+type Identity struct {
+	Username string
+	Roles    []string
+	// OAuth style scopes granted to the user.
+	Scopes []string
+	Claims map[string]interface{}
+	// Zero when the credentials don't expire.
+	ExpiresAt time.Time
+}
+
+// HasRole reports whether the identity has role. A nil identity has none.
+func (i *Identity) HasRole(role string) bool {
+	return i != nil && contains(i.Roles, role)
+}
+
+// HasScope reports whether the identity was granted scope. A nil identity
+// has none.
+func (i *Identity) HasScope(scope string) bool {
+	return i != nil && contains(i.Scopes, scope)
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator authenticates the HTTP request of a websocket upgrade. The
+// upgrade is refused with 401 Unauthorized when it returns an error,
+// otherwise the connection joins the session of the identity's username.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// TokenAuthenticator is implemented by Authenticators that can check a bare
+// token, letting clients re-authenticate without reconnecting.
+type TokenAuthenticator interface {
+	AuthenticateToken(token string) (*Identity, error)
+}
+
+// AuthenticatorFunc lets an ordinary function be used as an Authenticator.
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+// TokenExtractor returns the token carried by a request, or an empty string.
+type TokenExtractor func(r *http.Request) string
+
+// TokenFromHeader reads the token from a header, dropping a "Bearer " prefix.
+func TokenFromHeader(name string) TokenExtractor {
+	return func(r *http.Request) string {
+		value := strings.TrimSpace(r.Header.Get(name))
+		if len(value) > 7 && strings.EqualFold(value[:7], "bearer ") {
+			value = strings.TrimSpace(value[7:])
+		}
+		return value
+	}
+}
+
+// TokenFromQuery reads the token from a query parameter. Browsers can't set
+// headers on websocket requests so this is often the only option.
+func TokenFromQuery(param string) TokenExtractor {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(param)
+	}
+}
+
+// TokenFromCookie reads the token from a cookie.
+func TokenFromCookie(name string) TokenExtractor {
+	return func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	}
+}
+
+// JWTAuthenticator authenticates requests carrying a JWT.
+type JWTAuthenticator struct {
+	// Secret HMAC signed tokens are checked with, only used when Verify is nil.
+	Secret string
+	// Verification of tokens from an identity provider, such as RS256 tokens
+	// checked against a JWKS with issuer and audience checks.
+	Verify *common.VerifyOptions
+	// Where to look for the token, in order. Defaults to the Authorization
+	// header followed by the "token" query parameter.
+	Extractors []TokenExtractor
+	// Claim holding the username, "username" by default with "sub" as a
+	// fallback.
+	UsernameClaim string
+	// Claim holding the roles, "roles" by default.
+	RolesClaim string
+	// Claim holding the scopes, "scope" by default with "scp" as a fallback.
+	ScopesClaim string
+}
+
+func (a *JWTAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	token := a.token(r)
+	if token == "" {
+		return nil, ErrMissingToken
+	}
+	return a.AuthenticateToken(token)
+}
+
+func (a *JWTAuthenticator) AuthenticateToken(token string) (*Identity, error) {
+	var claims common.MapClaims
+	var err error
+	if a.Verify != nil {
+		claims, err = common.VerifyJWTWithOptions(token, *a.Verify)
+	} else {
+		claims, err = common.VerifyJWT(token, a.Secret)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid token: %w", err)
+	}
+	return identityFromClaims(claims, a.UsernameClaim, a.RolesClaim, a.ScopesClaim)
+}
+
+func (a *JWTAuthenticator) token(r *http.Request) string {
+	extractors := a.Extractors
+	if len(extractors) == 0 {
+		extractors = []TokenExtractor{TokenFromHeader("Authorization"), TokenFromQuery("token")}
+	}
+	for _, extract := range extractors {
+		if token := extract(r); token != "" {
+			return token
+		}
+	}
+	return ""
+}
+
+// identityFromClaims builds the identity described by verified JWT claims.
+func identityFromClaims(claims common.MapClaims, usernameClaim, rolesClaim, scopesClaim string) (*Identity, error) {
+	if usernameClaim == "" {
+		usernameClaim = "username"
+	}
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	if scopesClaim == "" {
+		scopesClaim = "scope"
+		if _, ok := claims[scopesClaim]; !ok {
+			scopesClaim = "scp"
+		}
+	}
+
+	username, _ := claims[usernameClaim].(string)
+	if username == "" {
+		username, _ = claims["sub"].(string)
+	}
+	if username == "" {
+		return nil, errors.New("invalid token: missing username")
+	}
+
+	identity := &Identity{
+		Username: username,
+		Roles:    stringList(claims[rolesClaim]),
+		Scopes:   stringList(claims[scopesClaim]),
+		Claims:   claims,
+	}
+	if exp, ok := claims["exp"].(float64); ok {
+		identity.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	return identity, nil
+}
+
+// stringList reads a claim holding either a list of strings or a single
+// space separated string.
+func stringList(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []string:
+		return v
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+// ClientCertAuthenticator authenticates requests by their TLS client
+// certificate. The server's tls.Config must verify client certificates, with
+// ClientAuth set to VerifyClientCertIfGiven or RequireAndVerifyClientCert.
+type ClientCertAuthenticator struct{}
+
+// Authenticate uses the certificate's common name as the username and its
+// organizational units as roles.
+func (ClientCertAuthenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil, errors.New("missing verified client certificate")
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	if cert.Subject.CommonName == "" {
+		return nil, errors.New("client certificate has no common name")
+	}
+	return &Identity{
+		Username:  cert.Subject.CommonName,
+		Roles:     cert.Subject.OrganizationalUnit,
+		ExpiresAt: cert.NotAfter,
+		Claims: map[string]interface{}{
+			"subject": cert.Subject.String(),
+			"issuer":  cert.Issuer.String(),
+			"serial":  cert.SerialNumber.String(),
+		},
+	}, nil
+}
+
+// SetIdentity sets the identity of a connection, for applications that
+// authenticate users themselves, e.g. in a login event. The roles and scopes
+// of the identity are then enforced by RequireRoles and RequireScopes.
+func (s *Sockets) SetIdentity(uuid string, identity *Identity) error {
+	s.RLock()
+	conn, ok := s.Connections[uuid]
+	s.RUnlock()
+	if !ok {
+		return fmt.Errorf("unable to find client connection for UUID %s", uuid)
+	}
+
+	conn.Lock()
+	conn.identity = identity
+	conn.Unlock()
+	if conn.Session != nil && conn.Username != "" {
+		conn.Session.setIdentity(identity)
+	}
+	s.scheduleExpiry(conn)
+	return nil
+}
+
+// Identity returns the identity the connection authenticated with, or nil.
+func (c *Connection) Identity() *Identity {
+	c.RLock()
+	defer c.RUnlock()
+	return c.identity
+}
+
+// attachSession adds conn to the session of username, creating the session
+// if needed.
+func (s *Sockets) attachSession(username string, conn *Connection) {
+	s.Lock()
+	defer s.Unlock()
+
+	session, exists := s.Sessions[username]
+	if !exists {
+		session = &Session{
+			Username:    username,
+			connections: make(map[string]*Connection),
+		}
+		s.Sessions[username] = session
+		s.config.Metrics.SessionsChanged(len(s.Sessions))
+	}
+	session.addConnection(conn)
+	session.setIdentity(conn.identity)
+	conn.addSession(session)
+}
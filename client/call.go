@@ -0,0 +1,168 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/xid"
+	"github.com/syleron/sockets/common"
+)
+
+// ErrConnectionClosed is returned by Call when the connection closes before a reply arrives.
+var ErrConnectionClosed = errors.New("connection closed")
+
+// pendingCalls tracks calls waiting for their correlated reply.
+type pendingCalls struct {
+	calls map[string]*pendingCall
+	sync.Mutex
+}
+
+type pendingCall struct {
+	reply chan *common.Message
+	// Set once the request was handed to a connection. Calls still waiting to
+	// be written survive a reconnect.
+	written bool
+}
+
+func newPendingCalls() *pendingCalls {
+	return &pendingCalls{
+		calls: make(map[string]*pendingCall),
+	}
+}
+
+func (p *pendingCalls) add(id string) chan *common.Message {
+	p.Lock()
+	defer p.Unlock()
+	reply := make(chan *common.Message, 1)
+	p.calls[id] = &pendingCall{reply: reply}
+	return reply
+}
+
+func (p *pendingCalls) remove(id string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.calls, id)
+}
+
+// resolve hands msg to the call it replies to. It returns false when no call
+// is waiting for it.
+func (p *pendingCalls) resolve(msg *common.Message) bool {
+	p.Lock()
+	defer p.Unlock()
+	call, ok := p.calls[msg.ReplyTo]
+	if !ok {
+		return false
+	}
+	delete(p.calls, msg.ReplyTo)
+	call.reply <- msg
+	return true
+}
+
+// markWritten records that the request of call id is being written. It
+// returns false when no call is waiting for it.
+func (p *pendingCalls) markWritten(id string) bool {
+	p.Lock()
+	defer p.Unlock()
+	call, ok := p.calls[id]
+	if ok {
+		call.written = true
+	}
+	return ok
+}
+
+// fail fails call id, if it is still waiting.
+func (p *pendingCalls) fail(id string) {
+	p.Lock()
+	defer p.Unlock()
+	if call, ok := p.calls[id]; ok {
+		close(call.reply)
+		delete(p.calls, id)
+	}
+}
+
+// failWritten fails the calls whose request was written to a connection that
+// dropped, their reply can no longer arrive.
+func (p *pendingCalls) failWritten() {
+	p.Lock()
+	defer p.Unlock()
+	for id, call := range p.calls {
+		if call.written {
+			close(call.reply)
+			delete(p.calls, id)
+		}
+	}
+}
+
+// Call sends event with payload to the server and waits for the reply that
+// carries the same message ID. It gives up when ctx is done. If the server
+// replied with an error the message is returned along with it. A request
+// that was not sent yet when the connection dropped waits for a reconnect,
+// one that was sent fails with ErrConnectionClosed.
+func (c *Client) Call(ctx context.Context, event string, payload interface{}) (*common.Message, error) {
+	msg := &common.Message{
+		EventName: event,
+		ID:        xid.New().String(),
+	}
+	if payload != nil {
+		if err := msg.SetData(c.Codec(), payload); err != nil {
+			return nil, fmt.Errorf("failed to encode payload: %w", err)
+		}
+	}
+
+	reply := c.pending.add(msg.ID)
+	defer c.pending.remove(msg.ID)
+
+	select {
+	case c.emitChan <- outgoing{msg: msg, compress: true}:
+	case <-c.closed:
+		return nil, ErrConnectionClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case res, ok := <-reply:
+		if !ok {
+			return nil, ErrConnectionClosed
+		}
+		if res.Error != nil {
+			return res, res.Error
+		}
+		return res, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reauthenticate replaces the token of the connection before it expires,
+// typically in response to common.TokenExpiringEvent. It returns when the new
+// token expires.
+func (c *Client) Reauthenticate(ctx context.Context, token string) (time.Time, error) {
+	expiry, err := Request[common.TokenExpiry](ctx, c, common.ReauthEvent, common.Reauth{Token: token})
+	return expiry.ExpiresAt, err
+}
@@ -0,0 +1,74 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/syleron/sockets/common"
+)
+
+func TestPendingCallsFailWritten(t *testing.T) {
+	p := newPendingCalls()
+	written := p.add("written")
+	queued := p.add("queued")
+
+	if !p.markWritten("written") {
+		t.Fatal("markWritten did not find the call")
+	}
+	if p.markWritten("unknown") {
+		t.Fatal("markWritten found an unknown call")
+	}
+	p.failWritten()
+
+	if _, ok := <-written; ok {
+		t.Error("written call was not failed")
+	}
+	select {
+	case <-queued:
+		t.Fatal("queued call was failed")
+	default:
+	}
+
+	// The queued call is still answered after a reconnect
+	if !p.resolve(&common.Message{ReplyTo: "queued"}) {
+		t.Fatal("queued call no longer pending")
+	}
+	if msg, ok := <-queued; !ok || msg.ReplyTo != "queued" {
+		t.Errorf("queued call got %v, %v", msg, ok)
+	}
+}
+
+func TestPendingCallsFail(t *testing.T) {
+	p := newPendingCalls()
+	reply := p.add("id")
+	p.fail("id")
+	p.fail("id")
+
+	if _, ok := <-reply; ok {
+		t.Error("call was not failed")
+	}
+	if p.resolve(&common.Message{ReplyTo: "id"}) {
+		t.Error("failed call resolved")
+	}
+}
@@ -28,10 +28,11 @@ import (
 	"fmt"
 	"github.com/gorilla/websocket"
 	"github.com/syleron/sockets/common"
-	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"sync"
+	"time"
 )
 
 type DataHandler interface {
@@ -48,10 +49,27 @@ type DataHandler interface {
 type Client struct {
 	Status   bool `json:"status"`
 	ws       *websocket.Conn
-	emitChan chan *common.Message
+	emitChan chan outgoing
 	handler  DataHandler
+	events   *eventRegistry
+	pending  *pendingCalls
+	config   *Config
+	protocol common.Protocol
 	Data     map[string]interface{}
+	// Session resumption state announced by the server
+	resumeToken string
+	lastSeq     uint64
 	sync.Mutex
+
+	// Where to dial, kept to reconnect with the same settings
+	addr   string
+	path   string
+	secure *Secure
+	// Guards ws, protocol and Status, which change on reconnect
+	connMu sync.RWMutex
+	// Closed once the client is closed for good
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 type Secure struct {
@@ -63,54 +81,160 @@ type Secure struct {
 }
 
 func Dial(addr, path string, secure *Secure, handler DataHandler) (*Client, error) {
+	return DialConfig(addr, path, secure, handler, &Config{})
+}
+
+// DialConfig is like Dial but with a client configuration.
+func DialConfig(addr, path string, secure *Secure, handler DataHandler, config *Config) (*Client, error) {
 	if handler == nil {
 		return nil, errors.New("data handler must not be nil")
 	}
+	if config == nil {
+		config = &Config{}
+	}
+	config.MergeDefaults()
+
+	if path == "" {
+		path = "/ws"
+	}
 
 	client := &Client{
-		emitChan: make(chan *common.Message),
+		config:   config,
+		emitChan: make(chan outgoing),
 		handler:  handler,
+		events:   newEventRegistry(),
+		pending:  newPendingCalls(),
 		Data:     make(map[string]interface{}),
+
+		resumeToken: config.ResumeToken,
+		lastSeq:     config.ResumeSeq,
+
+		addr:   addr,
+		path:   path,
+		secure: secure,
+		closed: make(chan struct{}),
 	}
 
-	if err := client.connect(addr, path, secure); err != nil {
+	if err := client.connect(); err != nil {
 		return nil, fmt.Errorf("failed to establish connection: %w", err)
 	}
 
 	return client, nil
 }
 
-func (c *Client) connect(addr, path string, secure *Secure) error {
-	dialer := websocket.DefaultDialer
+// connect runs the handshake and starts the goroutines serving the new
+// websocket.
+func (c *Client) connect() error {
+	ws, err := c.dial()
+	if err != nil {
+		return err
+	}
+
+	c.connMu.Lock()
+	select {
+	case <-c.closed:
+		// Closed while the handshake was in flight
+		c.connMu.Unlock()
+		ws.Close()
+		return ErrConnectionClosed
+	default:
+	}
+	c.ws = ws
+	c.protocol = common.FindProtocol(c.config.Protocols, ws.Subprotocol())
+	c.Status = true
+	c.connMu.Unlock()
+
+	if c.config.CompressionLevel != 0 {
+		if err := ws.SetCompressionLevel(c.config.CompressionLevel); err != nil {
+			c.config.Logger.Warn("invalid compression level", "level", c.config.CompressionLevel, "error", err)
+		}
+	}
+	c.handler.NewConnection()
+
+	done := make(chan struct{})
+	go c.handleIncoming(ws, done)
+	go c.handleOutgoing(ws, done)
+
+	return nil
+}
+
+func (c *Client) dial() (*websocket.Conn, error) {
+	// Copy the default dialer so our settings don't leak into other users of it
+	dialer := *websocket.DefaultDialer
 	scheme := "ws"
 
-	if secure != nil {
-		if err := configureDialer(dialer, secure); err != nil {
-			return err
+	dialer.EnableCompression = c.config.EnableCompression
+	dialer.Subprotocols = common.ProtocolNames(c.config.Protocols)
+
+	if c.secure != nil {
+		if err := configureDialer(&dialer, c.secure); err != nil {
+			return nil, err
 		}
-		if secure.EnableTLS {
+		if c.secure.EnableTLS {
 			scheme = "wss"
 		}
 	}
 
-	if path == "" {
-		path = "/ws"
+	url := url.URL{Scheme: scheme, Host: c.addr, Path: c.path}
+	if token, seq := c.ResumeToken(); token != "" {
+		query := url.Query()
+		query.Set("resume", token)
+		query.Set("seq", strconv.FormatUint(seq, 10))
+		url.RawQuery = query.Encode()
 	}
+	ws, _, err := dialer.Dial(url.String(), c.config.Header)
+	return ws, err
+}
 
-	url := url.URL{Scheme: scheme, Host: addr, Path: path}
-	ws, _, err := dialer.Dial(url.String(), nil)
-	if err != nil {
-		return err
-	}
+// ResumeToken returns the token and last sequence number needed to resume
+// this client's session after a disconnect. The token is empty unless the
+// server has session resumption enabled.
+func (c *Client) ResumeToken() (string, uint64) {
+	c.Lock()
+	defer c.Unlock()
+	return c.resumeToken, c.lastSeq
+}
 
-	c.ws = ws
-	c.Status = true
-	c.handler.NewConnection()
+// trackResume records the resume state carried by msg. It returns false for
+// messages that were already received before a resume.
+func (c *Client) trackResume(msg *common.Message) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if msg.EventName == common.ResumeEvent {
+		var info common.ResumeInfo
+		if err := c.Codec().Unmarshal(msg.Data, &info); err == nil {
+			if !info.Resumed {
+				// A fresh session numbers its messages from scratch
+				c.lastSeq = 0
+			}
+			c.resumeToken = info.Token
+		}
+		return true
+	}
+	if msg.Seq == 0 {
+		return true
+	}
+	if msg.Seq <= c.lastSeq {
+		return false
+	}
+	c.lastSeq = msg.Seq
+	return true
+}
 
-	go c.handleIncoming()
-	go c.handleOutgoing()
+// Protocol returns the subprotocol negotiated with the server.
+func (c *Client) Protocol() common.Protocol {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	if c.protocol.Codec == nil {
+		return common.DefaultProtocol
+	}
+	return c.protocol
+}
 
-	return nil
+// Codec returns the codec negotiated with the server.
+func (c *Client) Codec() common.Codec {
+	return c.Protocol().Codec
 }
 
 func configureDialer(dialer *websocket.Dialer, secure *Secure) error {
@@ -132,56 +256,167 @@ func configureDialer(dialer *websocket.Dialer, secure *Secure) error {
 	return nil
 }
 
-func (c *Client) handleIncoming() {
-	defer c.Close() // Ensure connection is closed after function exits
+func (c *Client) handleIncoming(ws *websocket.Conn, done chan struct{}) {
+	defer c.disconnected(ws, done)
 	for {
-		var msg common.Message
-		err := c.ws.ReadJSON(&msg)
+		_, data, err := ws.ReadMessage()
 		if err != nil {
+			if c.isClosed() {
+				break
+			}
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-				log.Printf("Error: %v", err)
+				c.config.Logger.Error("unexpected close", "remote", ws.RemoteAddr().String(), "error", err)
 				c.handler.NewClientError(err)
 			}
 			break
 		}
-		EventHandler(&msg)
+		var msg common.Message
+		if err := c.Codec().Unmarshal(data, &msg); err != nil {
+			c.config.Logger.Warn("failed to decode message", "error", err)
+			c.handler.NewClientError(err)
+			continue
+		}
+		if !c.trackResume(&msg) {
+			continue
+		}
+		// Replies to a pending Call are not dispatched as events
+		if msg.ReplyTo != "" && c.pending.resolve(&msg) {
+			continue
+		}
+		c.EventHandler(&msg)
 	}
 }
 
-func (c *Client) handleOutgoing() {
-	for message := range c.emitChan { // Will exit loop if channel is closed
-		if err := c.ws.WriteJSON(message); err != nil {
-			log.Printf("Failed to send message: %v", err)
+// disconnected cleans up after the read loop of ws exited and reconnects if
+// the policy allows it.
+func (c *Client) disconnected(ws *websocket.Conn, done chan struct{}) {
+	close(done)
+	ws.Close()
+	c.pending.failWritten()
+
+	c.connMu.Lock()
+	c.Status = false
+	c.connMu.Unlock()
+	c.handler.ConnectionClosed()
+
+	if c.config.Reconnect != nil && !c.isClosed() && c.reconnect() {
+		return
+	}
+	// Nobody is left to serve Emit
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+}
+
+// handleOutgoing writes the emitted messages to ws until done is closed.
+func (c *Client) handleOutgoing(ws *websocket.Conn, done chan struct{}) {
+	for {
+		var message outgoing
+		select {
+		case message = <-c.emitChan:
+		case <-done:
+			return
+		}
+		id := message.msg.ID
+		if id != "" && c.pending.markWritten(id) {
+			select {
+			case <-done:
+				// Dropped after failWritten ran, fail the call ourselves
+				c.pending.fail(id)
+				return
+			default:
+			}
+		}
+		data, err := c.Codec().Marshal(message.msg)
+		if err != nil {
+			c.config.Logger.Error("failed to encode message", "event", message.msg.EventName, "error", err)
+			c.handler.NewClientError(err)
+			c.pending.fail(id)
+			continue
+		}
+		messageType := websocket.TextMessage
+		if c.Codec().Binary() {
+			messageType = websocket.BinaryMessage
+		}
+		// Compression only applies if it was negotiated during the handshake
+		ws.EnableWriteCompression(message.compress && len(data) >= c.config.CompressionThreshold)
+		if err := ws.WriteMessage(messageType, data); err != nil {
+			c.config.Logger.Error("failed to send message", "event", message.msg.EventName, "error", err)
 			c.handler.NewClientError(err)
+			c.pending.fail(id)
 			continue
 		}
 	}
 }
 
+// outgoing is a message waiting to be written by handleOutgoing.
+type outgoing struct {
+	msg      *common.Message
+	compress bool
+}
+
+// Emit sends msg to the server. While the client is reconnecting it waits for
+// the new connection, once the client is closed the message is dropped.
 func (c *Client) Emit(msg *common.Message) {
-	c.emitChan <- msg
+	c.emit(outgoing{msg: msg, compress: true})
 }
 
-func (c *Client) Close() {
-	c.Status = false
+// EmitUncompressed is like Emit but never compresses the message, useful for
+// payloads that are already compressed.
+func (c *Client) EmitUncompressed(msg *common.Message) {
+	c.emit(outgoing{msg: msg})
+}
+
+func (c *Client) emit(message outgoing) {
+	select {
+	case c.emitChan <- message:
+	case <-c.closed:
+		c.config.Logger.Warn("message dropped, client is closed", "event", message.msg.EventName)
+	}
+}
 
-	if c.ws != nil {
-		if err := c.ws.Close(); err != nil {
-			log.Printf("Error closing WebSocket connection: %v", err)
+// Close closes the connection and stops reconnecting. ConnectionClosed is
+// called once the read loop has exited.
+func (c *Client) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	c.connMu.RLock()
+	ws := c.ws
+	c.connMu.RUnlock()
+	if ws != nil {
+		// Close frames may be written concurrently with the write pump
+		ws.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		if err := ws.Close(); err != nil {
+			c.config.Logger.Debug("error closing websocket connection", "error", err)
 		}
 	}
+}
 
-	c.handler.ConnectionClosed()
+func (c *Client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
 }
 
 func (c *Client) HandleEvent(pattern string, handler EventFunc) {
-	if events == nil {
-		events = make(map[string]EventFunc)
-	}
-	events[pattern] = handler
+	c.events.add(pattern, handler)
+}
+
+// RemoveEvent unregisters the handler for the given event.
+func (c *Client) RemoveEvent(pattern string) {
+	c.events.remove(pattern)
 }
 
 func (c *Client) IsConnected() bool {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
 	return c.Status
 }
 
@@ -0,0 +1,81 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"net/http"
+
+	"github.com/syleron/sockets/common"
+)
+
+type Config struct {
+	// Sent with the handshake request, e.g. an Authorization header carrying
+	// the token the server authenticates the connection with.
+	Header http.Header
+	// Protocols offered to the server as websocket subprotocols, in order of
+	// preference. common.DefaultProtocol is used when the server doesn't pick one.
+	Protocols []common.Protocol
+	// Shorthand for offering version 1 of the protocol for each codec, only
+	// used when Protocols is empty.
+	Codecs []common.Codec
+	// Negotiate permessage-deflate compression with the server.
+	EnableCompression bool
+	// Compression level from -2 (huffman only) to 9, zero uses the default level.
+	CompressionLevel int
+	// Messages smaller than this many bytes are sent uncompressed.
+	CompressionThreshold int
+	// Receives the client's logs, *slog.Logger can be used directly. Nothing
+	// is logged when nil.
+	Logger common.Logger
+	// Resume token and last sequence number from a previous connection, see
+	// Client.ResumeToken. The server replays the messages missed since then.
+	ResumeToken string
+	ResumeSeq   uint64
+	// Reconnect after the connection drops, Close stops it. The client stays
+	// disconnected when nil.
+	Reconnect *ReconnectPolicy
+}
+
+// MergeDefaults sets the uninitialized fields in the config with default values.
+func (c *Config) MergeDefaults() {
+	defaults := DefaultConfig()
+	if len(c.Codecs) == 0 {
+		c.Codecs = defaults.Codecs
+	}
+	if len(c.Protocols) == 0 {
+		c.Protocols = common.ProtocolsFor(c.Codecs)
+	}
+	if c.Logger == nil {
+		c.Logger = common.NopLogger
+	}
+	if c.Reconnect != nil {
+		c.Reconnect.mergeDefaults()
+	}
+}
+
+// DefaultConfig returns a configuration with default settings.
+func DefaultConfig() Config {
+	return Config{
+		Codecs: []common.Codec{common.JSON},
+	}
+}
@@ -22,15 +22,85 @@
 
 package client
 
-import "github.com/syleron/sockets/common"
+import (
+	"sync"
 
-var events map[string]EventFunc
+	"github.com/syleron/sockets/common"
+)
 
 type EventFunc func(msg *common.Message)
 
-func EventHandler(msg *common.Message) {
-	event := events[msg.EventName]
+// eventRegistry holds the event handlers of a single Client. It is safe to
+// register and remove handlers while events are being dispatched.
+type eventRegistry struct {
+	events  map[string]EventFunc
+	onError func(err *common.Error)
+	sync.RWMutex
+}
+
+func newEventRegistry() *eventRegistry {
+	return &eventRegistry{
+		events: make(map[string]EventFunc),
+	}
+}
+
+func (r *eventRegistry) add(pattern string, handler EventFunc) {
+	r.Lock()
+	defer r.Unlock()
+	r.events[pattern] = handler
+}
+
+func (r *eventRegistry) remove(pattern string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.events, pattern)
+}
+
+func (r *eventRegistry) get(pattern string) EventFunc {
+	r.RLock()
+	defer r.RUnlock()
+	return r.events[pattern]
+}
+
+func (r *eventRegistry) setOnError(handler func(err *common.Error)) {
+	r.Lock()
+	defer r.Unlock()
+	r.onError = handler
+}
+
+func (r *eventRegistry) getOnError() func(err *common.Error) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.onError
+}
+
+// OnError registers handler for the errors the server sends with
+// common.ErrorEvent that are not the reply to a pending Call, such as unknown
+// events or rate limiting. Without one they are passed to NewClientError.
+func (c *Client) OnError(handler func(err *common.Error)) {
+	c.events.setOnError(handler)
+}
+
+func (c *Client) EventHandler(msg *common.Message) {
+	if msg.EventName == common.ErrorEvent {
+		c.handleError(msg)
+		return
+	}
+	event := c.events.get(msg.EventName)
 	if event != nil {
 		event(msg)
 	}
 }
+
+// handleError dispatches an error sent by the server.
+func (c *Client) handleError(msg *common.Message) {
+	err := msg.Error
+	if err == nil {
+		err = &common.Error{Code: common.CodeInternal, Message: "unspecified error"}
+	}
+	if onError := c.events.getOnError(); onError != nil {
+		onError(err)
+		return
+	}
+	c.handler.NewClientError(err)
+}
@@ -0,0 +1,122 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ErrReconnectFailed is reported to NewClientError when the client gave up
+// reconnecting.
+var ErrReconnectFailed = errors.New("failed to reconnect")
+
+// ReconnectPolicy controls how a client reconnects after its connection
+// drops. Delays grow exponentially from InitialDelay up to MaxDelay.
+type ReconnectPolicy struct {
+	// Delay before the first attempt.
+	InitialDelay time.Duration
+	// Upper bound of the delay between attempts.
+	MaxDelay time.Duration
+	// Factor the delay grows by after each failed attempt.
+	Multiplier float64
+	// Fraction of each delay that is randomized so clients dropped at the same
+	// time don't reconnect in lockstep, from 0 to 1. Negative disables it.
+	Jitter float64
+	// Attempts made before giving up, zero retries forever.
+	MaxAttempts int
+	// Called before waiting delay for the given attempt, starting at 1.
+	OnReconnecting func(attempt int, delay time.Duration)
+	// Called once the handshake of the given attempt succeeded, after
+	// NewConnection.
+	OnReconnected func(attempt int)
+}
+
+func (p *ReconnectPolicy) mergeDefaults() {
+	if p.InitialDelay == 0 {
+		p.InitialDelay = 500 * time.Millisecond
+	}
+	if p.MaxDelay == 0 {
+		p.MaxDelay = 30 * time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	if p.Jitter == 0 {
+		p.Jitter = 0.5
+	}
+	if p.Jitter > 1 {
+		p.Jitter = 1
+	}
+}
+
+// delay returns how long to wait before the given attempt.
+func (p *ReconnectPolicy) delay(attempt int, random *rand.Rand) time.Duration {
+	delay := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * random.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// reconnect redials the server until it succeeds, the policy gives up or the
+// client is closed. It returns false when the client stays disconnected.
+func (c *Client) reconnect() bool {
+	policy := c.config.Reconnect
+	random := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	var err error
+	for attempt := 1; policy.MaxAttempts == 0 || attempt <= policy.MaxAttempts; attempt++ {
+		delay := policy.delay(attempt, random)
+		if policy.OnReconnecting != nil {
+			policy.OnReconnecting(attempt, delay)
+		}
+		c.config.Logger.Info("reconnecting", "attempt", attempt, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-c.closed:
+			timer.Stop()
+			return false
+		}
+
+		if err = c.connect(); err == nil {
+			if policy.OnReconnected != nil {
+				policy.OnReconnected(attempt)
+			}
+			return true
+		}
+		c.config.Logger.Warn("reconnect attempt failed", "attempt", attempt, "error", err)
+	}
+
+	c.config.Logger.Error("giving up reconnecting", "attempts", policy.MaxAttempts, "error", err)
+	c.handler.NewClientError(fmt.Errorf("%w after %d attempts: %v", ErrReconnectFailed, policy.MaxAttempts, err))
+	return false
+}
@@ -0,0 +1,232 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ReconnectPolicy
+		delays []time.Duration
+	}{
+		{
+			name:   "exponential",
+			policy: ReconnectPolicy{InitialDelay: 100 * time.Millisecond, MaxDelay: time.Minute, Multiplier: 2},
+			delays: []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond},
+		},
+		{
+			name:   "capped",
+			policy: ReconnectPolicy{InitialDelay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 3},
+			delays: []time.Duration{time.Second, 3 * time.Second, 5 * time.Second, 5 * time.Second},
+		},
+		{
+			name:   "constant",
+			policy: ReconnectPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 1},
+			delays: []time.Duration{time.Second, time.Second, time.Second},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.Jitter = -1
+			random := rand.New(rand.NewSource(1))
+			for i, want := range tt.delays {
+				if got := tt.policy.delay(i+1, random); got != want {
+					t.Errorf("attempt %d waits %v, want %v", i+1, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReconnectJitter(t *testing.T) {
+	policy := ReconnectPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 2, Jitter: 0.25}
+	random := rand.New(rand.NewSource(1))
+	var min, max time.Duration = time.Hour, 0
+	for i := 0; i < 1000; i++ {
+		delay := policy.delay(2, random)
+		if delay < 1500*time.Millisecond || delay > 2*time.Second {
+			t.Fatalf("delay %v outside of [1.5s, 2s]", delay)
+		}
+		if delay < min {
+			min = delay
+		}
+		if delay > max {
+			max = delay
+		}
+	}
+	if max-min < 250*time.Millisecond {
+		t.Errorf("delays only spread over %v", max-min)
+	}
+}
+
+func TestReconnectPolicyDefaults(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy ReconnectPolicy
+		want   ReconnectPolicy
+	}{
+		{
+			name:   "zero",
+			policy: ReconnectPolicy{},
+			want:   ReconnectPolicy{InitialDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second, Multiplier: 2, Jitter: 0.5},
+		},
+		{
+			name:   "kept",
+			policy: ReconnectPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 1.5, Jitter: 0.1, MaxAttempts: 3},
+			want:   ReconnectPolicy{InitialDelay: time.Second, MaxDelay: time.Minute, Multiplier: 1.5, Jitter: 0.1, MaxAttempts: 3},
+		},
+		{
+			name:   "shrinking multiplier",
+			policy: ReconnectPolicy{Multiplier: 0.5},
+			want:   ReconnectPolicy{InitialDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second, Multiplier: 2, Jitter: 0.5},
+		},
+		{
+			name:   "jitter disabled",
+			policy: ReconnectPolicy{Jitter: -1},
+			want:   ReconnectPolicy{InitialDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second, Multiplier: 2, Jitter: -1},
+		},
+		{
+			name:   "jitter capped",
+			policy: ReconnectPolicy{Jitter: 3},
+			want:   ReconnectPolicy{InitialDelay: 500 * time.Millisecond, MaxDelay: 30 * time.Second, Multiplier: 2, Jitter: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.policy.mergeDefaults()
+			if !reflect.DeepEqual(tt.policy, tt.want) {
+				t.Errorf("got %+v, want %+v", tt.policy, tt.want)
+			}
+		})
+	}
+}
+
+type testHandler struct {
+	errors chan error
+}
+
+func (h *testHandler) NewConnection()    {}
+func (h *testHandler) ConnectionClosed() {}
+func (h *testHandler) NewClientError(err error) {
+	h.errors <- err
+}
+
+// newTestServer starts a websocket server that passes every connection to
+// serve, and returns its address.
+func newTestServer(t *testing.T, serve func(ws *websocket.Conn)) (*httptest.Server, string) {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		serve(ws)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestReconnect(t *testing.T) {
+	connections := make(chan *websocket.Conn, 4)
+	_, addr := newTestServer(t, func(ws *websocket.Conn) { connections <- ws })
+
+	reconnected := make(chan int, 1)
+	c, err := DialConfig(addr, "/ws", nil, &testHandler{errors: make(chan error, 4)}, &Config{
+		Reconnect: &ReconnectPolicy{
+			InitialDelay:  time.Millisecond,
+			Jitter:        -1,
+			OnReconnected: func(attempt int) { reconnected <- attempt },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Drop the connection without a close frame
+	(<-connections).UnderlyingConn().Close()
+	select {
+	case attempt := <-reconnected:
+		if attempt != 1 {
+			t.Errorf("reconnected on attempt %d, want 1", attempt)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	<-connections
+	if !c.IsConnected() {
+		t.Error("client is not connected after reconnecting")
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	connections := make(chan *websocket.Conn, 1)
+	srv, addr := newTestServer(t, func(ws *websocket.Conn) { connections <- ws })
+
+	handler := &testHandler{errors: make(chan error, 4)}
+	var attempts []int
+	c, err := DialConfig(addr, "/ws", nil, handler, &Config{
+		Reconnect: &ReconnectPolicy{
+			InitialDelay:   time.Millisecond,
+			MaxAttempts:    2,
+			OnReconnecting: func(attempt int, delay time.Duration) { attempts = append(attempts, attempt) },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Nothing accepts the redials
+	srv.Listener.Close()
+	(<-connections).UnderlyingConn().Close()
+
+	select {
+	case err := <-handler.errors:
+		if !errors.Is(err, ErrReconnectFailed) {
+			t.Fatalf("got %v, want ErrReconnectFailed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not give up")
+	}
+	if len(attempts) != 2 || attempts[0] != 1 || attempts[1] != 2 {
+		t.Errorf("attempts %v, want [1 2]", attempts)
+	}
+	if c.IsConnected() {
+		t.Error("client is connected")
+	}
+}
@@ -0,0 +1,61 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package client
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/syleron/sockets/common"
+)
+
+// On registers a handler receiving the data of event decoded into T with the
+// negotiated codec. Malformed payloads are reported to NewClientError.
+func On[T any](c *Client, event string, handler func(payload T)) {
+	c.HandleEvent(event, func(msg *common.Message) {
+		var payload T
+		if len(msg.Data) > 0 {
+			if err := c.Codec().Unmarshal(msg.Data, &payload); err != nil {
+				c.config.Logger.Warn("failed to decode payload", "event", event, "error", err)
+				c.handler.NewClientError(fmt.Errorf("malformed %s payload: %w", event, err))
+				return
+			}
+		}
+		handler(payload)
+	})
+}
+
+// Request is like Call but decodes the reply into R.
+func Request[R any](ctx context.Context, c *Client, event string, payload interface{}) (R, error) {
+	var res R
+	msg, err := c.Call(ctx, event, payload)
+	if err != nil {
+		return res, err
+	}
+	if len(msg.Data) > 0 {
+		if err := c.Codec().Unmarshal(msg.Data, &res); err != nil {
+			return res, fmt.Errorf("failed to decode reply: %w", err)
+		}
+	}
+	return res, nil
+}
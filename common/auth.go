@@ -0,0 +1,48 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import "time"
+
+// Events used to keep the credentials of a connection fresh.
+const (
+	// Sent by the server ahead of the token expiring, with TokenExpiry as data.
+	TokenExpiringEvent = "sockets:token_expiring"
+	// Sent by the client with Reauth as data to replace its token. The reply
+	// carries the new TokenExpiry.
+	ReauthEvent = "sockets:reauth"
+)
+
+// CloseTokenExpired is the close code sent when a connection's token expired
+// without being refreshed.
+const CloseTokenExpired = 4401
+
+// TokenExpiry tells the client when its token expires.
+type TokenExpiry struct {
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Reauth carries a fresh token for the connection.
+type Reauth struct {
+	Token string `json:"token"`
+}
@@ -0,0 +1,924 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// binaryEncoder writes values in a binary wire format.
+type binaryEncoder interface {
+	writeNil()
+	writeBool(b bool)
+	writeInt(n int64)
+	writeUint(n uint64)
+	writeFloat(f float64)
+	writeString(s string)
+	writeBytes(b []byte)
+	writeArrayHeader(n int)
+	writeMapHeader(n int)
+}
+
+// binaryDecoder reads values of a binary wire format one item at a time.
+// Arrays and maps are returned as a header, their elements follow.
+type binaryDecoder interface {
+	next() (binaryItem, error)
+	// atBreak consumes the end of an indefinite length array or map.
+	atBreak() bool
+	offset() int
+	name() string
+}
+
+type itemKind int
+
+const (
+	itemNil itemKind = iota
+	itemBool
+	itemInt
+	itemUint
+	itemFloat
+	itemString
+	itemBytes
+	itemArray
+	itemMap
+)
+
+var itemKindNames = [...]string{"nil", "bool", "integer", "integer", "float", "string", "bytes", "array", "map"}
+
+func (k itemKind) String() string {
+	return itemKindNames[k]
+}
+
+// binaryItem is a decoded scalar or the header of an array or map. The bytes
+// of strings may point into the decoded data and must be copied to be kept.
+type binaryItem struct {
+	kind       itemKind
+	b          bool
+	i          int64
+	u          uint64
+	f          float64
+	s          []byte
+	n          int
+	indefinite bool
+}
+
+// more reports whether the array or map of item has an element left after i
+// elements were read.
+func more(d binaryDecoder, item binaryItem, i int) bool {
+	if item.indefinite {
+		return !d.atBreak()
+	}
+	return i < item.n
+}
+
+// maxEncodeDepth bounds how deeply nested an encoded value may be, it stops
+// cyclic values.
+const maxEncodeDepth = 1000
+
+var (
+	marshalerType       = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	unmarshalerType     = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+	numberType          = reflect.TypeOf(json.Number(""))
+	timeType            = reflect.TypeOf(time.Time{})
+)
+
+// encodeValue writes v following the rules of encoding/json: struct tags,
+// omitempty, json.Marshaler and encoding.TextMarshaler are honoured. Values
+// implementing json.Marshaler are converted from their JSON form.
+func encodeValue(e binaryEncoder, v reflect.Value, depth int) error {
+	if depth > maxEncodeDepth {
+		return errors.New("maximum nesting depth exceeded while encoding")
+	}
+	if !v.IsValid() {
+		e.writeNil()
+		return nil
+	}
+
+	t := v.Type()
+	switch t {
+	case numberType:
+		return encodeNumber(e, json.Number(v.String()))
+	case timeType:
+		// Same text as its MarshalJSON, without the JSON pass
+		text, err := v.Interface().(time.Time).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.writeString(string(text))
+		return nil
+	}
+	if t.Implements(marshalerType) {
+		if t.Kind() == reflect.Ptr && v.IsNil() {
+			e.writeNil()
+			return nil
+		}
+		return encodeMarshaler(e, v.Interface().(json.Marshaler), depth)
+	}
+	if v.CanAddr() && reflect.PtrTo(t).Implements(marshalerType) {
+		return encodeMarshaler(e, v.Addr().Interface().(json.Marshaler), depth)
+	}
+	if t.Implements(textMarshalerType) {
+		if t.Kind() == reflect.Ptr && v.IsNil() {
+			e.writeNil()
+			return nil
+		}
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		if err != nil {
+			return err
+		}
+		e.writeString(string(text))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		e.writeBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.writeFloat(v.Float())
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.writeNil()
+			return nil
+		}
+		return encodeValue(e, v.Elem(), depth+1)
+	case reflect.Slice:
+		if v.IsNil() {
+			e.writeNil()
+			return nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 && !reflect.PtrTo(t.Elem()).Implements(marshalerType) {
+			e.writeBytes(v.Bytes())
+			return nil
+		}
+		return encodeArray(e, v, depth)
+	case reflect.Array:
+		return encodeArray(e, v, depth)
+	case reflect.Map:
+		if v.IsNil() {
+			e.writeNil()
+			return nil
+		}
+		return encodeMap(e, v, depth)
+	case reflect.Struct:
+		return encodeStruct(e, v, depth, "")
+	default:
+		return fmt.Errorf("unsupported type %s", t)
+	}
+	return nil
+}
+
+func encodeArray(e binaryEncoder, v reflect.Value, depth int) error {
+	e.writeArrayHeader(v.Len())
+	for i := 0; i < v.Len(); i++ {
+		if err := encodeValue(e, v.Index(i), depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeMap(e binaryEncoder, v reflect.Value, depth int) error {
+	type entry struct {
+		key   string
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		key, err := mapKeyString(iter.Key())
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry{key, iter.Value()})
+	}
+	// Sorted so encoding is deterministic
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+
+	e.writeMapHeader(len(entries))
+	for _, entry := range entries {
+		e.writeString(entry.key)
+		if err := encodeValue(e, entry.value, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mapKeyString(key reflect.Value) (string, error) {
+	if key.Kind() == reflect.String {
+		return key.String(), nil
+	}
+	if tm, ok := key.Interface().(encoding.TextMarshaler); ok {
+		text, err := tm.MarshalText()
+		return string(text), err
+	}
+	switch key.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(key.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(key.Uint(), 10), nil
+	}
+	return "", fmt.Errorf("unsupported map key type %s", key.Type())
+}
+
+// encodeStruct writes the fields of struct v as a map. The field named raw
+// holds a payload already encoded with the codec and is written as is.
+func encodeStruct(e binaryEncoder, v reflect.Value, depth int, raw string) error {
+	fields := cachedFields(v.Type())
+	// The map header needs the number of fields that are written
+	n := 0
+	for i := range fields {
+		if _, ok := structFieldValue(v, &fields[i]); ok {
+			n++
+		}
+	}
+
+	e.writeMapHeader(n)
+	for i := range fields {
+		field := &fields[i]
+		value, ok := structFieldValue(v, field)
+		if !ok {
+			continue
+		}
+		e.writeString(field.name)
+		if field.name == raw {
+			if value.Len() == 0 {
+				// An empty payload is written as nil
+				e.writeNil()
+			} else {
+				e.(rawWriter).writeRaw(value.Bytes())
+			}
+			continue
+		}
+		if err := encodeValue(e, value, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// structFieldValue returns the value of field in v and whether it is written.
+func structFieldValue(v reflect.Value, field *structField) (reflect.Value, bool) {
+	value, ok := fieldByIndex(v, field.index)
+	if !ok || (field.omitEmpty && isEmptyValue(value)) {
+		return reflect.Value{}, false
+	}
+	return value, true
+}
+
+// rawWriter is implemented by encoders that can embed encoded values.
+type rawWriter interface {
+	writeRaw(b []byte)
+}
+
+// encodeMarshaler writes the JSON form of m.
+func encodeMarshaler(e binaryEncoder, m json.Marshaler, depth int) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var tree interface{}
+	if err := dec.Decode(&tree); err != nil {
+		return err
+	}
+	return encodeValue(e, reflect.ValueOf(tree), depth+1)
+}
+
+// encodeNumber writes a JSON number as an integer when it is one.
+func encodeNumber(e binaryEncoder, n json.Number) error {
+	if n == "" {
+		// Like encoding/json, an empty number is zero
+		n = "0"
+	}
+	if i, err := n.Int64(); err == nil {
+		e.writeInt(i)
+		return nil
+	}
+	if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+		e.writeUint(u)
+		return nil
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return err
+	}
+	e.writeFloat(f)
+	return nil
+}
+
+func isEmptyValue(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+// structField is a field of a struct as seen by encoding/json.
+type structField struct {
+	name      string
+	index     []int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]structField
+
+func cachedFields(t reflect.Type) []structField {
+	if fields, ok := fieldCache.Load(t); ok {
+		return fields.([]structField)
+	}
+	fields, _ := fieldCache.LoadOrStore(t, typeFields(t))
+	return fields.([]structField)
+}
+
+// typeFields lists the fields of t, promoting those of embedded structs. A
+// field hides the fields of the same name that are nested deeper.
+func typeFields(t reflect.Type) []structField {
+	var fields []structField
+	seen := make(map[string]bool)
+
+	type level struct {
+		t     reflect.Type
+		index []int
+	}
+	current := []level{{t: t}}
+	visited := map[reflect.Type]bool{}
+	for len(current) > 0 {
+		var next []level
+		names := make(map[string]bool)
+		for _, l := range current {
+			if visited[l.t] {
+				continue
+			}
+			visited[l.t] = true
+
+			for i := 0; i < l.t.NumField(); i++ {
+				f := l.t.Field(i)
+				tag := f.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				name, opts, _ := strings.Cut(tag, ",")
+				index := append(append([]int(nil), l.index...), i)
+
+				ft := f.Type
+				if ft.Kind() == reflect.Ptr {
+					ft = ft.Elem()
+				}
+				if f.Anonymous && name == "" && ft.Kind() == reflect.Struct {
+					next = append(next, level{t: ft, index: index})
+					continue
+				}
+				if !f.IsExported() {
+					continue
+				}
+				if name == "" {
+					name = f.Name
+				}
+				if seen[name] {
+					continue
+				}
+				names[name] = true
+				fields = append(fields, structField{
+					name:      name,
+					index:     index,
+					omitEmpty: strings.Contains(","+opts+",", ",omitempty,"),
+				})
+			}
+		}
+		for name := range names {
+			seen[name] = true
+		}
+		current = next
+	}
+	return fields
+}
+
+// fieldByIndex returns the field of v at index. It returns false when an
+// embedded pointer on the way is nil.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, true
+}
+
+// settableField is like fieldByIndex but allocates nil embedded pointers.
+func settableField(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func findField(fields []structField, key string) *structField {
+	for i := range fields {
+		if fields[i].name == key {
+			return &fields[i]
+		}
+	}
+	for i := range fields {
+		if strings.EqualFold(fields[i].name, key) {
+			return &fields[i]
+		}
+	}
+	return nil
+}
+
+// decodeTop decodes a complete document into v.
+func decodeTop(d binaryDecoder, data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("%s: cannot decode into %T", d.name(), v)
+	}
+	item, err := d.next()
+	if err != nil {
+		return err
+	}
+	if err := decodeValue(d, item, rv.Elem(), 0); err != nil {
+		return err
+	}
+	if d.offset() != len(data) {
+		return fmt.Errorf("%s: trailing data", d.name())
+	}
+	return nil
+}
+
+// decodeValue stores item, and the elements following it, in v following the
+// rules of encoding/json. An invalid v skips the value.
+func decodeValue(d binaryDecoder, item binaryItem, v reflect.Value, depth int) error {
+	if depth > maxDecodeDepth {
+		return errMaxDepth
+	}
+	if !v.IsValid() {
+		return skipValue(d, item, depth)
+	}
+	if item.kind == itemNil {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+
+	// Allocate pointers on the way, stopping at a decoding method
+	for {
+		if v.Kind() != reflect.Ptr && v.CanAddr() {
+			addr := v.Addr()
+			if v.Type() == timeType && item.kind == itemString {
+				return addr.Interface().(*time.Time).UnmarshalText(item.s)
+			}
+			if addr.Type().Implements(unmarshalerType) {
+				return decodeUnmarshaler(d, item, addr.Interface().(json.Unmarshaler), depth)
+			}
+			if item.kind == itemString && addr.Type().Implements(textUnmarshalerType) {
+				return addr.Interface().(encoding.TextUnmarshaler).UnmarshalText(item.s)
+			}
+		}
+		if v.Kind() != reflect.Ptr {
+			break
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	if v.Kind() == reflect.Interface {
+		if v.NumMethod() != 0 {
+			return decodeError(d, item, v.Type())
+		}
+		value, err := decodeAny(d, item, depth, false)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(value))
+		}
+		return nil
+	}
+
+	switch item.kind {
+	case itemBool:
+		if v.Kind() != reflect.Bool {
+			return decodeError(d, item, v.Type())
+		}
+		v.SetBool(item.b)
+	case itemInt, itemUint, itemFloat:
+		return decodeNumber(d, item, v)
+	case itemString:
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(item.s))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			// Byte slices are base64 strings in JSON
+			b, err := base64.StdEncoding.DecodeString(string(item.s))
+			if err != nil {
+				return fmt.Errorf("%s: %w", d.name(), err)
+			}
+			v.SetBytes(b)
+		default:
+			return decodeError(d, item, v.Type())
+		}
+	case itemBytes:
+		switch {
+		case v.Kind() == reflect.String:
+			v.SetString(string(item.s))
+		case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8:
+			v.SetBytes(append([]byte(nil), item.s...))
+		default:
+			return decodeError(d, item, v.Type())
+		}
+	case itemArray:
+		return decodeArray(d, item, v, depth)
+	case itemMap:
+		switch v.Kind() {
+		case reflect.Struct:
+			return decodeStruct(d, item, v, depth, "", nil)
+		case reflect.Map:
+			return decodeMap(d, item, v, depth)
+		}
+		return decodeError(d, item, v.Type())
+	}
+	return nil
+}
+
+func decodeError(d binaryDecoder, item binaryItem, t reflect.Type) error {
+	return fmt.Errorf("%s: cannot decode %s into %s", d.name(), item.kind, t)
+}
+
+func decodeNumber(d binaryDecoder, item binaryItem, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch item.kind {
+		case itemInt:
+			n = item.i
+		case itemFloat:
+			if item.f != math.Trunc(item.f) || item.f < math.MinInt64 || item.f >= math.MaxInt64 {
+				return decodeError(d, item, v.Type())
+			}
+			n = int64(item.f)
+		default:
+			return decodeError(d, item, v.Type())
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%s: %d overflows %s", d.name(), n, v.Type())
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch {
+		case item.kind == itemUint:
+			n = item.u
+		case item.kind == itemInt && item.i >= 0:
+			n = uint64(item.i)
+		case item.kind == itemFloat && item.f >= 0 && item.f < math.MaxUint64 && item.f == math.Trunc(item.f):
+			n = uint64(item.f)
+		default:
+			return decodeError(d, item, v.Type())
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("%s: %d overflows %s", d.name(), n, v.Type())
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(itemFloat64(item))
+	default:
+		if v.Type() == numberType {
+			v.SetString(itemNumber(item))
+			return nil
+		}
+		return decodeError(d, item, v.Type())
+	}
+	return nil
+}
+
+func itemFloat64(item binaryItem) float64 {
+	switch item.kind {
+	case itemInt:
+		return float64(item.i)
+	case itemUint:
+		return float64(item.u)
+	}
+	return item.f
+}
+
+func itemNumber(item binaryItem) string {
+	switch item.kind {
+	case itemInt:
+		return strconv.FormatInt(item.i, 10)
+	case itemUint:
+		return strconv.FormatUint(item.u, 10)
+	}
+	return strconv.FormatFloat(item.f, 'g', -1, 64)
+}
+
+func decodeArray(d binaryDecoder, item binaryItem, v reflect.Value, depth int) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), 0, item.n)
+		for i := 0; more(d, item, i); i++ {
+			slice = reflect.Append(slice, reflect.Zero(v.Type().Elem()))
+			if err := decodeNext(d, slice.Index(i), depth); err != nil {
+				return err
+			}
+		}
+		v.Set(slice)
+	case reflect.Array:
+		i := 0
+		for ; more(d, item, i); i++ {
+			var elem reflect.Value
+			if i < v.Len() {
+				elem = v.Index(i)
+			}
+			if err := decodeNext(d, elem, depth); err != nil {
+				return err
+			}
+		}
+		for ; i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+	default:
+		return decodeError(d, item, v.Type())
+	}
+	return nil
+}
+
+func decodeMap(d binaryDecoder, item binaryItem, v reflect.Value, depth int) error {
+	t := v.Type()
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(t, item.n))
+	}
+	for i := 0; more(d, item, i); i++ {
+		key, err := decodeKey(d, depth)
+		if err != nil {
+			return err
+		}
+		mapKey, err := mapKeyValue(d, key, t.Key())
+		if err != nil {
+			return err
+		}
+		elem := reflect.New(t.Elem()).Elem()
+		if err := decodeNext(d, elem, depth); err != nil {
+			return err
+		}
+		v.SetMapIndex(mapKey, elem)
+	}
+	return nil
+}
+
+func mapKeyValue(d binaryDecoder, key string, t reflect.Type) (reflect.Value, error) {
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		k := reflect.New(t)
+		if err := k.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(key)); err != nil {
+			return reflect.Value{}, err
+		}
+		return k.Elem(), nil
+	}
+	k := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		k.SetString(key)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(key, 10, 64)
+		if err != nil || k.OverflowInt(n) {
+			return reflect.Value{}, fmt.Errorf("%s: invalid map key %q for %s", d.name(), key, t)
+		}
+		k.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(key, 10, 64)
+		if err != nil || k.OverflowUint(n) {
+			return reflect.Value{}, fmt.Errorf("%s: invalid map key %q for %s", d.name(), key, t)
+		}
+		k.SetUint(n)
+	default:
+		return reflect.Value{}, fmt.Errorf("%s: unsupported map key type %s", d.name(), t)
+	}
+	return k, nil
+}
+
+// decodeStruct stores a map in the fields of struct v. The value of the raw
+// key is not decoded, it is passed to capture along with its encoding.
+func decodeStruct(d binaryDecoder, item binaryItem, v reflect.Value, depth int, raw string, capture func(start, end int, null bool)) error {
+	fields := cachedFields(v.Type())
+	for i := 0; more(d, item, i); i++ {
+		key, err := decodeKey(d, depth)
+		if err != nil {
+			return err
+		}
+		if raw != "" && key == raw {
+			start := d.offset()
+			value, err := d.next()
+			if err != nil {
+				return err
+			}
+			if err := skipValue(d, value, depth+1); err != nil {
+				return err
+			}
+			capture(start, d.offset(), value.kind == itemNil)
+			continue
+		}
+
+		var field reflect.Value
+		if f := findField(fields, key); f != nil {
+			field = settableField(v, f.index)
+		}
+		if err := decodeNext(d, field, depth); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeKey reads a map key. Keys other than strings are formatted.
+func decodeKey(d binaryDecoder, depth int) (string, error) {
+	item, err := d.next()
+	if err != nil {
+		return "", err
+	}
+	if item.kind == itemString || item.kind == itemBytes {
+		return string(item.s), nil
+	}
+	key, err := decodeAny(d, item, depth+1, false)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprint(key), nil
+}
+
+func decodeNext(d binaryDecoder, v reflect.Value, depth int) error {
+	item, err := d.next()
+	if err != nil {
+		return err
+	}
+	return decodeValue(d, item, v, depth+1)
+}
+
+// decodeUnmarshaler passes the JSON form of the value to u.
+func decodeUnmarshaler(d binaryDecoder, item binaryItem, u json.Unmarshaler, depth int) error {
+	tree, err := decodeAny(d, item, depth, true)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return fmt.Errorf("%s: %w", d.name(), err)
+	}
+	return u.UnmarshalJSON(data)
+}
+
+// decodeAny decodes a value into nil, bool, float64, string, []byte,
+// []interface{} and map[string]interface{} values, like encoding/json does.
+// Numbers are json.Number values when numbers is set.
+func decodeAny(d binaryDecoder, item binaryItem, depth int, numbers bool) (interface{}, error) {
+	if depth > maxDecodeDepth {
+		return nil, errMaxDepth
+	}
+	switch item.kind {
+	case itemNil:
+		return nil, nil
+	case itemBool:
+		return item.b, nil
+	case itemInt, itemUint, itemFloat:
+		if numbers {
+			return json.Number(itemNumber(item)), nil
+		}
+		return itemFloat64(item), nil
+	case itemString:
+		return string(item.s), nil
+	case itemBytes:
+		return append([]byte(nil), item.s...), nil
+	case itemArray:
+		items := make([]interface{}, 0, item.n)
+		for i := 0; more(d, item, i); i++ {
+			next, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeAny(d, next, depth+1, numbers)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	case itemMap:
+		m := make(map[string]interface{}, item.n)
+		for i := 0; more(d, item, i); i++ {
+			key, err := decodeKey(d, depth)
+			if err != nil {
+				return nil, err
+			}
+			next, err := d.next()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeAny(d, next, depth+1, numbers)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = value
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("%s: unexpected %s", d.name(), item.kind)
+}
+
+// skipValue reads past the elements of item.
+func skipValue(d binaryDecoder, item binaryItem, depth int) error {
+	if depth > maxDecodeDepth {
+		return errMaxDepth
+	}
+	count := 1
+	switch item.kind {
+	case itemArray:
+	case itemMap:
+		count = 2
+	default:
+		return nil
+	}
+	for i := 0; more(d, item, i); i++ {
+		for j := 0; j < count; j++ {
+			next, err := d.next()
+			if err != nil {
+				return err
+			}
+			if err := skipValue(d, next, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,303 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// CBOR major types
+const (
+	cborUint   = 0
+	cborNegInt = 1
+	cborBytes  = 2
+	cborText   = 3
+	cborArray  = 4
+	cborMap    = 5
+	cborTag    = 6
+	cborSimple = 7
+)
+
+// cborIndefinite is the additional information value for indefinite lengths.
+const cborIndefinite = 31
+
+var errCBORShort = errors.New("cbor: unexpected end of data")
+
+// cborEncoder writes values in the CBOR format.
+type cborEncoder struct {
+	buf *bytes.Buffer
+}
+
+func newCBOREncoder(buf *bytes.Buffer) binaryEncoder {
+	return cborEncoder{buf: buf}
+}
+
+func (e cborEncoder) writeNil() {
+	e.buf.WriteByte(0xf6)
+}
+
+func (e cborEncoder) writeBool(b bool) {
+	if b {
+		e.buf.WriteByte(0xf5)
+	} else {
+		e.buf.WriteByte(0xf4)
+	}
+}
+
+func (e cborEncoder) writeInt(n int64) {
+	cborInt(e.buf, n)
+}
+
+func (e cborEncoder) writeUint(n uint64) {
+	cborHeader(e.buf, cborUint, n)
+}
+
+func (e cborEncoder) writeFloat(f float64) {
+	e.buf.WriteByte(0xfb)
+	binary.Write(e.buf, binary.BigEndian, math.Float64bits(f))
+}
+
+func (e cborEncoder) writeString(s string) {
+	cborHeader(e.buf, cborText, uint64(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e cborEncoder) writeBytes(b []byte) {
+	cborHeader(e.buf, cborBytes, uint64(len(b)))
+	e.buf.Write(b)
+}
+
+func (e cborEncoder) writeArrayHeader(n int) {
+	cborHeader(e.buf, cborArray, uint64(n))
+}
+
+func (e cborEncoder) writeMapHeader(n int) {
+	cborHeader(e.buf, cborMap, uint64(n))
+}
+
+func (e cborEncoder) writeRaw(b []byte) {
+	e.buf.Write(b)
+}
+
+func cborInt(buf *bytes.Buffer, n int64) {
+	if n >= 0 {
+		cborHeader(buf, cborUint, uint64(n))
+		return
+	}
+	cborHeader(buf, cborNegInt, uint64(-1-n))
+}
+
+// cborHeader writes the initial byte for major type and its argument n in
+// the shortest form.
+func cborHeader(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+type cborDecoder struct {
+	data []byte
+	pos  int
+}
+
+func newCBORDecoder(data []byte) binaryDecoder {
+	return &cborDecoder{data: data}
+}
+
+func (d *cborDecoder) name() string {
+	return "cbor"
+}
+
+func (d *cborDecoder) offset() int {
+	return d.pos
+}
+
+func (d *cborDecoder) read(n uint64) ([]byte, error) {
+	if uint64(len(d.data)-d.pos) < n {
+		return nil, errCBORShort
+	}
+	b := d.data[d.pos : d.pos+int(n)]
+	d.pos += int(n)
+	return b, nil
+}
+
+// header reads an initial byte and its argument. For indefinite lengths
+// indefinite is true and n is zero.
+func (d *cborDecoder) header() (major, info byte, n uint64, indefinite bool, err error) {
+	b, err := d.read(1)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	major, info = b[0]>>5, b[0]&0x1f
+
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info <= 27:
+		b, err := d.read(1 << (info - 24))
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		return major, info, n, false, nil
+	case info == cborIndefinite && major != cborUint && major != cborNegInt && major != cborTag:
+		return major, info, 0, true, nil
+	}
+	return 0, 0, 0, false, fmt.Errorf("cbor: invalid additional information %d", info)
+}
+
+// atBreak consumes the break code ending an indefinite length item.
+func (d *cborDecoder) atBreak() bool {
+	if d.pos < len(d.data) && d.data[d.pos] == 0xff {
+		d.pos++
+		return true
+	}
+	return false
+}
+
+func (d *cborDecoder) next() (binaryItem, error) {
+	major, info, n, indefinite, err := d.header()
+	// Tags only add semantics to the enclosed value, which is kept as is
+	for err == nil && major == cborTag {
+		major, info, n, indefinite, err = d.header()
+	}
+	if err != nil {
+		return binaryItem{}, err
+	}
+
+	switch major {
+	case cborUint:
+		if n <= math.MaxInt64 {
+			return binaryItem{kind: itemInt, i: int64(n)}, nil
+		}
+		return binaryItem{kind: itemUint, u: n}, nil
+	case cborNegInt:
+		if n > math.MaxInt64 {
+			return binaryItem{kind: itemFloat, f: -1 - float64(n)}, nil
+		}
+		return binaryItem{kind: itemInt, i: -1 - int64(n)}, nil
+	case cborBytes, cborText:
+		b, err := d.str(major, n, indefinite)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		if major == cborText {
+			return binaryItem{kind: itemString, s: b}, nil
+		}
+		return binaryItem{kind: itemBytes, s: b}, nil
+	case cborArray:
+		// Every element takes at least one byte
+		if n > uint64(len(d.data)-d.pos) {
+			return binaryItem{}, errCBORShort
+		}
+		return binaryItem{kind: itemArray, n: int(n), indefinite: indefinite}, nil
+	case cborMap:
+		// Every entry takes at least two bytes
+		if n > uint64(len(d.data)-d.pos)/2 {
+			return binaryItem{}, errCBORShort
+		}
+		return binaryItem{kind: itemMap, n: int(n), indefinite: indefinite}, nil
+	}
+
+	// Major type 7, simple values and floats
+	switch info {
+	case 20, 21:
+		return binaryItem{kind: itemBool, b: info == 21}, nil
+	case 22, 23:
+		return binaryItem{kind: itemNil}, nil
+	case 25:
+		return binaryItem{kind: itemFloat, f: halfToFloat64(uint16(n))}, nil
+	case 26:
+		return binaryItem{kind: itemFloat, f: float64(math.Float32frombits(uint32(n)))}, nil
+	case 27:
+		return binaryItem{kind: itemFloat, f: math.Float64frombits(n)}, nil
+	}
+	return binaryItem{}, fmt.Errorf("cbor: unsupported simple value %d", info)
+}
+
+func (d *cborDecoder) str(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		return d.read(n)
+	}
+
+	// Indefinite strings are a series of definite chunks of the same type
+	var out []byte
+	for !d.atBreak() {
+		chunkMajor, _, size, chunkIndefinite, err := d.header()
+		if err != nil {
+			return nil, err
+		}
+		if chunkMajor != major || chunkIndefinite {
+			return nil, errors.New("cbor: invalid indefinite string chunk")
+		}
+		b, err := d.read(size)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b...)
+	}
+	return out, nil
+}
+
+// halfToFloat64 converts an IEEE 754 half precision float.
+func halfToFloat64(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,168 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// Codec encodes and decodes messages on the wire. The codec used by a
+// connection is negotiated through the websocket subprotocol.
+type Codec interface {
+	// Name identifies the codec, it doubles as the websocket subprotocol.
+	Name() string
+	// Binary reports whether encoded messages are sent as binary frames.
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	// JSON encodes messages as JSON text frames. It is the default codec.
+	JSON Codec = jsonCodec{}
+	// MsgPack encodes messages as MessagePack binary frames.
+	MsgPack Codec = &binaryCodec{name: "msgpack", newEncoder: newMsgPackEncoder, newDecoder: newMsgPackDecoder}
+	// CBOR encodes messages as CBOR binary frames.
+	CBOR Codec = &binaryCodec{name: "cbor", newEncoder: newCBOREncoder, newDecoder: newCBORDecoder}
+)
+
+// maxDecodeDepth bounds how deeply nested a decoded binary value may be.
+const maxDecodeDepth = 64
+
+var errMaxDepth = errors.New("maximum nesting depth exceeded")
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := asMessage(v); ok && m.dataCodec != nil {
+		converted, err := m.withJSONData()
+		if err != nil {
+			return nil, err
+		}
+		v = converted
+	}
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(*Message); ok {
+		m.dataCodec = nil
+	}
+	return json.Unmarshal(data, v)
+}
+
+// binaryCodec encodes values in a binary format following the rules of
+// encoding/json, so struct tags behave exactly as they do with the JSON codec.
+// Values are encoded and decoded directly, without a JSON pass, except for
+// types implementing json.Marshaler or json.Unmarshaler. Byte slices are
+// encoded as binary rather than base64 strings.
+//
+// Message.Data is kept in the codec's own encoding so a payload is only
+// decoded once, by whoever knows its type. Data in another encoding is
+// converted when the message is marshaled.
+type binaryCodec struct {
+	name       string
+	newEncoder func(buf *bytes.Buffer) binaryEncoder
+	newDecoder func(data []byte) binaryDecoder
+}
+
+func (c *binaryCodec) Name() string {
+	return c.name
+}
+
+func (c *binaryCodec) Binary() bool {
+	return true
+}
+
+func (c *binaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	e := c.newEncoder(&buf)
+
+	var err error
+	if m, ok := asMessage(v); ok {
+		if m.dataCodec != Codec(c) {
+			// Data is JSON or encoded with another codec
+			if m, err = m.withJSONData(); err != nil {
+				return nil, err
+			}
+		}
+		raw := ""
+		if m.dataCodec == Codec(c) {
+			raw = "data"
+		}
+		err = encodeStruct(e, reflect.ValueOf(m).Elem(), 0, raw)
+	} else {
+		err = encodeValue(e, reflect.ValueOf(v), 0)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", c.name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *binaryCodec) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(*Message); ok {
+		return c.unmarshalMessage(data, m)
+	}
+	return decodeTop(c.newDecoder(data), data, v)
+}
+
+func (c *binaryCodec) unmarshalMessage(data []byte, m *Message) error {
+	d := c.newDecoder(data)
+	item, err := d.next()
+	if err != nil {
+		return err
+	}
+	if item.kind != itemMap {
+		return fmt.Errorf("%s: message is not a map", c.name)
+	}
+
+	*m = Message{}
+	err = decodeStruct(d, item, reflect.ValueOf(m).Elem(), 0, "data", func(start, end int, null bool) {
+		m.Data = nil
+		m.dataCodec = nil
+		if !null {
+			m.Data = append(json.RawMessage(nil), data[start:end]...)
+			m.dataCodec = c
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if d.offset() != len(data) {
+		return fmt.Errorf("%s: trailing data", c.name)
+	}
+	return nil
+}
@@ -0,0 +1,394 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var codecs = []Codec{JSON, MsgPack, CBOR}
+
+type Base struct {
+	ID      int    `json:"id"`
+	Skipped string `json:"-"`
+}
+
+type Payload struct {
+	Base
+	Name     string            `json:"name"`
+	Count    uint16            `json:"count,omitempty"`
+	Small    int8              `json:"small"`
+	Big      uint64            `json:"big"`
+	Negative int64             `json:"negative"`
+	Ratio    float64           `json:"ratio"`
+	Tags     []string          `json:"tags"`
+	Scores   map[int]float32   `json:"scores"`
+	Labels   map[string]string `json:"labels,omitempty"`
+	Blob     []byte            `json:"blob"`
+	When     time.Time         `json:"when"`
+	Next     *Payload          `json:"next,omitempty"`
+	Any      interface{}       `json:"any"`
+	Fixed    [2]bool           `json:"fixed"`
+	Number   json.Number       `json:"number"`
+	private  int
+}
+
+func testPayload() Payload {
+	return Payload{
+		Base:     Base{ID: 7},
+		Name:     "café",
+		Small:    -100,
+		Big:      math.MaxUint64,
+		Negative: math.MinInt64,
+		Ratio:    0.25,
+		Tags:     []string{"a", strings.Repeat("b", 300)},
+		Scores:   map[int]float32{1: 1.5, -2: 2},
+		Blob:     []byte{0, 1, 2, 255},
+		When:     time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Next:     &Payload{Name: "next", Tags: []string{}, Number: "0"},
+		Any:      map[string]interface{}{"list": []interface{}{1.0, "x", nil, true}},
+		Fixed:    [2]bool{true, false},
+		Number:   "12",
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			want := testPayload()
+			data, err := codec.Marshal(want)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			var got Payload
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip\n got %+v\nwant %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestCodecMessageRoundTrip(t *testing.T) {
+	for _, codec := range codecs {
+		t.Run(codec.Name(), func(t *testing.T) {
+			payload, err := codec.Marshal(map[string]int{"a": 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := Message{
+				EventName: "event",
+				ID:        "id",
+				Seq:       3,
+				Error:     &Error{Code: CodeBadRequest, Message: "bad", Details: []interface{}{"x"}},
+			}
+			if err := want.SetData(codec, map[string]int{"a": 1}); err != nil {
+				t.Fatal(err)
+			}
+			data, err := codec.Marshal(&want)
+			if err != nil {
+				t.Fatalf("Marshal: %v", err)
+			}
+			var got Message
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip\n got %+v\nwant %+v", got, want)
+			}
+
+			// A response encodes its data with the codec, readable as a message
+			data, err = codec.Marshal(Response{EventName: "event", Data: map[string]int{"a": 1}})
+			if err != nil {
+				t.Fatalf("Marshal response: %v", err)
+			}
+			got = Message{}
+			if err := codec.Unmarshal(data, &got); err != nil {
+				t.Fatalf("Unmarshal response: %v", err)
+			}
+			if !bytes.Equal(got.Data, payload) {
+				t.Errorf("response data = %x, want %x", got.Data, payload)
+			}
+		})
+	}
+}
+
+func TestCodecEmptyMessageData(t *testing.T) {
+	for _, codec := range codecs[1:] {
+		data, err := codec.Marshal(&Message{EventName: "event"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Message
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Data != nil {
+			t.Errorf("%s: data = %x, want nil", codec.Name(), got.Data)
+		}
+	}
+}
+
+func TestCodecInterfaceMatchesJSON(t *testing.T) {
+	doc := `{"a":[1,2.5,"x",null,true,{"b":-3}],"c":{}}`
+	var want interface{}
+	if err := json.Unmarshal([]byte(doc), &want); err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range codecs[1:] {
+		data, err := codec.Marshal(json.RawMessage(doc))
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", codec.Name(), err)
+		}
+		var got interface{}
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", codec.Name(), err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", codec.Name(), got, want)
+		}
+	}
+}
+
+func TestCodecWireFormat(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		value interface{}
+		want  []byte
+	}{
+		{MsgPack, map[string]int{"a": 1}, []byte{0x81, 0xa1, 'a', 0x01}},
+		{MsgPack, []int64{-1, -33, 256}, []byte{0x93, 0xff, 0xd0, 0xdf, 0xcd, 0x01, 0x00}},
+		{MsgPack, []byte{1}, []byte{0xc4, 0x01, 0x01}},
+		{CBOR, map[string]int{"a": 1}, []byte{0xa1, 0x61, 'a', 0x01}},
+		{CBOR, []int64{-1, -25, 256}, []byte{0x83, 0x20, 0x38, 0x18, 0x19, 0x01, 0x00}},
+		{CBOR, []byte{1}, []byte{0x41, 0x01}},
+	}
+	for _, tt := range tests {
+		got, err := tt.codec.Marshal(tt.value)
+		if err != nil {
+			t.Fatalf("%s: Marshal(%v): %v", tt.codec.Name(), tt.value, err)
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: Marshal(%v) = %x, want %x", tt.codec.Name(), tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCodecDecodeForeignEncodings(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		data  []byte
+		want  interface{}
+	}{
+		// float32 and uint64 beyond int64
+		{MsgPack, []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, 1.5},
+		{MsgPack, []byte{0xcf, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, float64(math.MaxUint64)},
+		// Indefinite length array, string chunks and a tag
+		{CBOR, []byte{0x9f, 0x01, 0x7f, 0x61, 'a', 0x61, 'b', 0xff, 0xff}, []interface{}{1.0, "ab"}},
+		{CBOR, []byte{0xc1, 0x19, 0x01, 0x00}, 256.0},
+		// Half precision float
+		{CBOR, []byte{0xf9, 0x3e, 0x00}, 1.5},
+	}
+	for _, tt := range tests {
+		var got interface{}
+		if err := tt.codec.Unmarshal(tt.data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal(%x): %v", tt.codec.Name(), tt.data, err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: Unmarshal(%x) = %#v, want %#v", tt.codec.Name(), tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestCodecTruncatedInput(t *testing.T) {
+	for _, codec := range codecs[1:] {
+		msg := &Message{EventName: "event", ID: "id"}
+		msg.SetData(codec, testPayload())
+		data, err := codec.Marshal(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(data); i++ {
+			var got Message
+			if err := codec.Unmarshal(data[:i], &got); err == nil {
+				t.Fatalf("%s: Unmarshal of %d/%d bytes succeeded", codec.Name(), i, len(data))
+			}
+			var payload Payload
+			if err := codec.Unmarshal(msg.Data[:i%len(msg.Data)], &payload); err == nil {
+				t.Fatalf("%s: Unmarshal of truncated payload succeeded", codec.Name())
+			}
+		}
+		var got Message
+		if err := codec.Unmarshal(append(data, 0), &got); err == nil {
+			t.Errorf("%s: trailing data accepted", codec.Name())
+		}
+	}
+}
+
+func TestCodecOversizedLength(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		data  []byte
+	}{
+		{MsgPack, []byte{0xdd, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{MsgPack, []byte{0xdf, 0xff, 0xff, 0xff, 0xff, 0x01, 0x01}},
+		{MsgPack, []byte{0xdb, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{MsgPack, []byte{0xc6, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{CBOR, []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}},
+		{CBOR, []byte{0xbb, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0x01}},
+		{CBOR, []byte{0x7b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 'a'}},
+		{CBOR, []byte{0x5a, 0xff, 0xff, 0xff, 0xff, 'a'}},
+	}
+	for _, tt := range tests {
+		var got interface{}
+		if err := tt.codec.Unmarshal(tt.data, &got); err == nil {
+			t.Errorf("%s: Unmarshal(%x) succeeded", tt.codec.Name(), tt.data)
+		}
+		var msg Message
+		if err := tt.codec.Unmarshal(tt.data, &msg); err == nil {
+			t.Errorf("%s: Unmarshal(%x) into a message succeeded", tt.codec.Name(), tt.data)
+		}
+	}
+}
+
+func TestCodecMaxDepth(t *testing.T) {
+	tests := []struct {
+		codec Codec
+		open  byte
+		value byte
+		// A message map holding a single "data" key
+		message []byte
+	}{
+		{MsgPack, 0x91, 0x01, []byte{0x81, 0xa4, 'd', 'a', 't', 'a'}},
+		{CBOR, 0x81, 0x01, []byte{0xa1, 0x64, 'd', 'a', 't', 'a'}},
+	}
+	for _, tt := range tests {
+		data := append(bytes.Repeat([]byte{tt.open}, maxDecodeDepth+2), tt.value)
+		var got interface{}
+		if err := tt.codec.Unmarshal(data, &got); err == nil {
+			t.Errorf("%s: nesting beyond the maximum depth accepted", tt.codec.Name())
+		}
+		var msg Message
+		if err := tt.codec.Unmarshal(append(tt.message, data...), &msg); err == nil {
+			t.Errorf("%s: nested message data accepted", tt.codec.Name())
+		}
+	}
+}
+
+func TestCodecTypeMismatch(t *testing.T) {
+	for _, codec := range codecs[1:] {
+		data, _ := codec.Marshal(map[string]interface{}{"id": "seven", "small": 1000})
+		var got Payload
+		if err := codec.Unmarshal(data, &got); err == nil {
+			t.Errorf("%s: string decoded into an int", codec.Name())
+		}
+		data, _ = codec.Marshal(map[string]interface{}{"small": 1000})
+		if err := codec.Unmarshal(data, &got); err == nil {
+			t.Errorf("%s: overflowing int8 accepted", codec.Name())
+		}
+	}
+}
+
+func BenchmarkCodecMarshal(b *testing.B) {
+	payload := testPayload()
+	for _, codec := range codecs {
+		b.Run(codec.Name(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				codec.Marshal(Response{EventName: "event", Data: payload})
+			}
+		})
+	}
+}
+
+func BenchmarkCodecUnmarshal(b *testing.B) {
+	for _, codec := range codecs {
+		data, _ := codec.Marshal(testPayload())
+		b.Run(codec.Name(), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var payload Payload
+				codec.Unmarshal(data, &payload)
+			}
+		})
+	}
+}
+
+func TestCodecMessageDataConversion(t *testing.T) {
+	payload := map[string]interface{}{"name": "a", "tags": []interface{}{"x", 1.5}}
+	for _, from := range codecs {
+		for _, to := range codecs {
+			t.Run(from.Name()+" to "+to.Name(), func(t *testing.T) {
+				msg := &Message{EventName: "event"}
+				if err := msg.SetData(from, payload); err != nil {
+					t.Fatal(err)
+				}
+				data, err := to.Marshal(msg)
+				if err != nil {
+					t.Fatalf("Marshal: %v", err)
+				}
+				var got Message
+				if err := to.Unmarshal(data, &got); err != nil {
+					t.Fatalf("Unmarshal: %v", err)
+				}
+				var decoded interface{}
+				if err := to.Unmarshal(got.Data, &decoded); err != nil {
+					t.Fatalf("Unmarshal data: %v", err)
+				}
+				if !reflect.DeepEqual(decoded, payload) {
+					t.Errorf("data = %v, want %v", decoded, payload)
+				}
+			})
+		}
+	}
+
+	// Data assigned directly is JSON
+	for _, codec := range codecs {
+		data, err := codec.Marshal(Message{EventName: "event", Data: json.RawMessage(`{"a":1}`)})
+		if err != nil {
+			t.Fatalf("%s: Marshal: %v", codec.Name(), err)
+		}
+		var got Message
+		if err := codec.Unmarshal(data, &got); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", codec.Name(), err)
+		}
+		var decoded map[string]int
+		if err := codec.Unmarshal(got.Data, &decoded); err != nil || decoded["a"] != 1 {
+			t.Errorf("%s: data = %v, %v", codec.Name(), decoded, err)
+		}
+	}
+
+	// Data that doesn't match its codec can't be converted
+	msg := &Message{EventName: "event"}
+	msg.SetData(MsgPack, 1)
+	msg.Data = json.RawMessage(`{"a":1}`)
+	if _, err := CBOR.Marshal(msg); err == nil {
+		t.Error("converted data that is not MessagePack")
+	}
+}
@@ -0,0 +1,296 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// jwksMinRefresh bounds how often an unknown kid triggers a reload, whether
+// the previous reload succeeded or not.
+const jwksMinRefresh = 10 * time.Second
+
+// JWKS is a KeySet loaded from a JSON Web Key Set document. RSA, EC (P-256,
+// P-384 and P-521) and OKP (Ed25519) keys are supported.
+type JWKS struct {
+	source    string
+	client    *http.Client
+	keys      map[string]jsonWebKey
+	attempted time.Time
+	// Serializes reloads so concurrent lookups share a single fetch
+	refreshing sync.Mutex
+	done       chan struct{}
+	closeOnce  sync.Once
+	sync.RWMutex
+}
+
+type jsonWebKey struct {
+	alg string
+	key interface{}
+}
+
+// NewJWKS loads a key set from a file path or an http(s) URL. When refresh
+// is positive the key set is reloaded in the background at that interval,
+// keys with an unknown kid also trigger a reload so rotated keys are picked
+// up early. Close stops the background reloads.
+func NewJWKS(source string, refresh time.Duration) (*JWKS, error) {
+	set := &JWKS{
+		source: source,
+		client: &http.Client{Timeout: 10 * time.Second},
+		done:   make(chan struct{}),
+	}
+	if err := set.Refresh(); err != nil {
+		return nil, err
+	}
+	if refresh > 0 {
+		go set.refreshEvery(refresh)
+	}
+	return set, nil
+}
+
+// ParseJWKS returns the static key set described by a JWKS document.
+func ParseJWKS(data []byte) (*JWKS, error) {
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return nil, err
+	}
+	return &JWKS{keys: keys, done: make(chan struct{})}, nil
+}
+
+// Key returns the key with the given kid, checking it may be used with alg.
+func (s *JWKS) Key(kid, alg string) (interface{}, error) {
+	s.RLock()
+	key, ok := s.keys[kid]
+	s.RUnlock()
+
+	if !ok && s.source != "" {
+		// A failed reload keeps the previous keys, the kid stays unknown
+		s.refreshStale()
+		s.RLock()
+		key, ok = s.keys[kid]
+		s.RUnlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+	if key.alg != "" && key.alg != alg {
+		return nil, fmt.Errorf("key %q can't be used with %s", kid, alg)
+	}
+	return key.key, nil
+}
+
+// Refresh reloads the key set from its source.
+func (s *JWKS) Refresh() error {
+	if s.source == "" {
+		return nil
+	}
+	s.refreshing.Lock()
+	defer s.refreshing.Unlock()
+	return s.refresh()
+}
+
+// refreshStale reloads the key set unless the last attempt was too recent.
+// Callers arriving during a reload wait for it instead of starting another.
+func (s *JWKS) refreshStale() error {
+	s.refreshing.Lock()
+	defer s.refreshing.Unlock()
+
+	s.RLock()
+	recent := time.Since(s.attempted) < jwksMinRefresh
+	s.RUnlock()
+	if recent {
+		return nil
+	}
+	return s.refresh()
+}
+
+// refresh reloads the key set, the caller must hold the refreshing lock.
+func (s *JWKS) refresh() error {
+	s.Lock()
+	s.attempted = time.Now()
+	s.Unlock()
+
+	data, err := s.fetch()
+	if err != nil {
+		return fmt.Errorf("failed to load JWKS from %s: %w", s.source, err)
+	}
+	keys, err := parseJWKS(data)
+	if err != nil {
+		return fmt.Errorf("failed to parse JWKS from %s: %w", s.source, err)
+	}
+
+	s.Lock()
+	s.keys = keys
+	s.Unlock()
+	return nil
+}
+
+// Close stops the background reloads.
+func (s *JWKS) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+func (s *JWKS) refreshEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Keep the previous keys when the source is unavailable
+			s.Refresh()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *JWKS) fetch() ([]byte, error) {
+	if !strings.HasPrefix(s.source, "http://") && !strings.HasPrefix(s.source, "https://") {
+		return os.ReadFile(s.source)
+	}
+	resp, err := s.client.Get(s.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+func parseJWKS(data []byte) (map[string]jsonWebKey, error) {
+	var document struct {
+		Keys []map[string]interface{} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]jsonWebKey)
+	for _, raw := range document.Keys {
+		if use, _ := raw["use"].(string); use != "" && use != "sig" {
+			continue
+		}
+		key, err := parseJWK(raw)
+		if err != nil {
+			return nil, err
+		}
+		if key == nil {
+			// Key types and curves we don't know are skipped
+			continue
+		}
+		kid, _ := raw["kid"].(string)
+		alg, _ := raw["alg"].(string)
+		keys[kid] = jsonWebKey{alg: alg, key: key}
+	}
+	return keys, nil
+}
+
+func parseJWK(raw map[string]interface{}) (interface{}, error) {
+	kty, _ := raw["kty"].(string)
+	kid, _ := raw["kid"].(string)
+	switch kty {
+	case "RSA":
+		n, err := jwkBytes(raw, "n")
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		e, err := jwkBytes(raw, "e")
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 || exponent.Int64() < 3 {
+			return nil, fmt.Errorf("key %q: invalid RSA exponent", kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch crv, _ := raw["crv"].(string); crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			// Like unknown key types, keys on curves we don't support are skipped
+			return nil, nil
+		}
+		x, err := jwkBytes(raw, "x")
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		y, err := jwkBytes(raw, "y")
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("key %q: point is not on the curve", kid)
+		}
+		return key, nil
+	case "OKP":
+		if crv, _ := raw["crv"].(string); crv != "Ed25519" {
+			return nil, nil
+		}
+		x, err := jwkBytes(raw, "x")
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", kid, err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %q: invalid Ed25519 key size", kid)
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, nil
+}
+
+func jwkBytes(raw map[string]interface{}, name string) ([]byte, error) {
+	value, _ := raw[name].(string)
+	if value == "" {
+		return nil, errors.New("missing " + name)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return b, nil
+}
@@ -0,0 +1,237 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// jwksServer serves a JWKS document with the keys it is given and counts the
+// requests it receives.
+type jwksServer struct {
+	*httptest.Server
+	keys     map[string]ed25519.PublicKey
+	failing  bool
+	requests int32
+	sync.Mutex
+}
+
+func newJWKSServer(t *testing.T) *jwksServer {
+	t.Helper()
+	srv := &jwksServer{keys: make(map[string]ed25519.PublicKey)}
+	srv.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&srv.requests, 1)
+		srv.Lock()
+		defer srv.Unlock()
+		if srv.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var keys []map[string]string
+		for kid, key := range srv.keys {
+			keys = append(keys, map[string]string{
+				"kty": "OKP",
+				"crv": "Ed25519",
+				"kid": kid,
+				"alg": "EdDSA",
+				"x":   base64.RawURLEncoding.EncodeToString(key),
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// rotate replaces the served keys with a new key for kid and returns its
+// private half.
+func (srv *jwksServer) rotate(t *testing.T, kid string) ed25519.PrivateKey {
+	t.Helper()
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Lock()
+	defer srv.Unlock()
+	srv.keys = map[string]ed25519.PublicKey{kid: public}
+	return private
+}
+
+func (srv *jwksServer) fail() {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.failing = true
+}
+
+func (srv *jwksServer) count() int {
+	return int(atomic.LoadInt32(&srv.requests))
+}
+
+// expire lets the next unknown kid reload the key set right away.
+func expire(set *JWKS) {
+	set.Lock()
+	defer set.Unlock()
+	set.attempted = time.Now().Add(-jwksMinRefresh)
+}
+
+func TestJWKSRotation(t *testing.T) {
+	srv := newJWKSServer(t)
+	first := srv.rotate(t, "first")
+	set, err := NewJWKS(srv.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := VerifyOptions{Algorithms: []string{"EdDSA"}, Keys: set}
+
+	token, _ := SignJWT(MapClaims{"sub": "alice"}, "EdDSA", first, "first")
+	if _, err := VerifyJWTWithOptions(token, opts); err != nil {
+		t.Fatalf("first key: %v", err)
+	}
+
+	second := srv.rotate(t, "second")
+	token, _ = SignJWT(MapClaims{"sub": "alice"}, "EdDSA", second, "second")
+	if _, err := VerifyJWTWithOptions(token, opts); err == nil {
+		t.Fatal("rotated key was used before the reload interval")
+	}
+	expire(set)
+	if _, err := VerifyJWTWithOptions(token, opts); err != nil {
+		t.Fatalf("rotated key: %v", err)
+	}
+	if got := srv.count(); got != 2 {
+		t.Errorf("fetched the key set %d times, want 2", got)
+	}
+}
+
+func TestJWKSUnknownKid(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.rotate(t, "known")
+	set, err := NewJWKS(srv.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expire(set)
+
+	// Concurrent lookups share a single reload
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := set.Key("unknown", "EdDSA"); err == nil || !strings.Contains(err.Error(), "unknown key id") {
+				t.Errorf("Key = %v, want an unknown key id error", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := srv.count(); got != 2 {
+		t.Errorf("fetched the key set %d times, want 2", got)
+	}
+
+	if _, err := set.Key("known", "ES256"); err == nil {
+		t.Error("key was accepted for another algorithm")
+	}
+}
+
+func TestJWKSFailingFetch(t *testing.T) {
+	srv := newJWKSServer(t)
+	srv.rotate(t, "known")
+	set, err := NewJWKS(srv.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv.fail()
+	expire(set)
+	for i := 0; i < 3; i++ {
+		if _, err := set.Key("unknown", "EdDSA"); err == nil || !strings.Contains(err.Error(), "unknown key id") {
+			t.Fatalf("Key = %v, want an unknown key id error", err)
+		}
+	}
+	if got := srv.count(); got != 2 {
+		t.Errorf("fetched the key set %d times, want 2", got)
+	}
+	if _, err := set.Key("known", "EdDSA"); err != nil {
+		t.Errorf("previous key was lost: %v", err)
+	}
+	if err := set.Refresh(); err == nil {
+		t.Error("Refresh succeeded against a failing source")
+	}
+	if _, err := NewJWKS(srv.URL, 0); err == nil {
+		t.Error("NewJWKS succeeded against a failing source")
+	}
+}
+
+func TestParseJWKSMixedKeys(t *testing.T) {
+	okp, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding.EncodeToString
+	document, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "OKP", "crv": "Ed25519", "kid": "ed25519", "x": b64(okp)},
+		{"kty": "EC", "crv": "P-256", "kid": "p256", "x": b64(ec.X.Bytes()), "y": b64(ec.Y.Bytes())},
+		{"kty": "EC", "crv": "secp256k1", "kid": "secp256k1", "x": b64(ec.X.Bytes()), "y": b64(ec.Y.Bytes())},
+		{"kty": "OKP", "crv": "Ed448", "kid": "ed448", "x": b64(make([]byte, 57))},
+		{"kty": "OKP", "crv": "X25519", "kid": "x25519", "x": b64(okp)},
+		{"kty": "oct", "kid": "oct", "k": b64([]byte("secret"))},
+	}})
+
+	set, err := ParseJWKS(document)
+	if err != nil {
+		t.Fatalf("ParseJWKS: %v", err)
+	}
+	for kid, alg := range map[string]string{"ed25519": "EdDSA", "p256": "ES256"} {
+		if _, err := set.Key(kid, alg); err != nil {
+			t.Errorf("Key(%s): %v", kid, err)
+		}
+	}
+	for _, kid := range []string{"secp256k1", "ed448", "x25519", "oct"} {
+		if _, err := set.Key(kid, "EdDSA"); err == nil || !strings.Contains(err.Error(), "unknown key id") {
+			t.Errorf("Key(%s) = %v, want an unknown key id error", kid, err)
+		}
+	}
+
+	// Supported keys that are malformed still fail the document
+	document, _ = json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		{"kty": "OKP", "crv": "Ed25519", "kid": "short", "x": b64(okp[:16])},
+	}})
+	if _, err := ParseJWKS(document); err == nil {
+		t.Error("malformed Ed25519 key was accepted")
+	}
+}
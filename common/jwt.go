@@ -23,9 +23,10 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/golang-jwt/jwt"
-	"log"
 	"time"
 )
 
@@ -51,6 +52,9 @@ func (t *JWT) validate() error {
 func DecodeJWT(tokenString, tokenKey string) (bool, JWT) {
 	var jwtt = JWT{}
 	token, err := jwt.ParseWithClaims(tokenString, &jwtt, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
 		return []byte(tokenKey), nil
 	})
 	if err != nil {
@@ -61,9 +65,7 @@ func DecodeJWT(tokenString, tokenKey string) (bool, JWT) {
 		if !ok {
 			return false, JWT{}
 		}
-		err := claims.validate()
-		if err != nil {
-			log.Println(err)
+		if err := claims.validate(); err != nil {
 			return false, JWT{}
 		}
 		return true, *claims
@@ -71,6 +73,131 @@ func DecodeJWT(tokenString, tokenKey string) (bool, JWT) {
 	return false, JWT{}
 }
 
+// HMACAlgorithms are the algorithms of tokens signed with a shared secret.
+var HMACAlgorithms = []string{"HS256", "HS384", "HS512"}
+
+// KeySet looks up verification keys by the kid header of a token.
+type KeySet interface {
+	Key(kid, alg string) (interface{}, error)
+}
+
+// VerifyOptions configures VerifyJWTWithOptions.
+type VerifyOptions struct {
+	// Signing algorithms accepted, e.g. "RS256", "ES256" or "EdDSA". Tokens
+	// signed with any other algorithm are rejected.
+	Algorithms []string
+	// Key used for tokens without a kid header, or for every token when Keys
+	// is nil. A []byte secret for HMAC, otherwise an *rsa.PublicKey,
+	// *ecdsa.PublicKey or ed25519.PublicKey.
+	Key interface{}
+	// Keys looked up by the kid header of the token, e.g. a JWKS.
+	Keys KeySet
+	// Expected iss claim, not checked when empty.
+	Issuer string
+	// Accepted aud claims, the token must carry one of them. Not checked
+	// when empty.
+	Audience []string
+	// Clock skew tolerated when checking exp, nbf and iat.
+	Leeway time.Duration
+}
+
+// VerifyJWT checks the signature of an HMAC signed token along with its
+// expiry and returns its claims.
+func VerifyJWT(tokenString, tokenKey string) (MapClaims, error) {
+	return VerifyJWTWithOptions(tokenString, VerifyOptions{
+		Algorithms: HMACAlgorithms,
+		Key:        []byte(tokenKey),
+	})
+}
+
+// VerifyJWTWithOptions checks the signature and claims of a token and returns
+// its claims.
+func VerifyJWTWithOptions(tokenString string, opts VerifyOptions) (MapClaims, error) {
+	if len(opts.Algorithms) == 0 {
+		return nil, errors.New("no signing algorithms allowed")
+	}
+
+	parser := &jwt.Parser{
+		ValidMethods: opts.Algorithms,
+		// Claims are checked below, with leeway
+		SkipClaimsValidation: true,
+	}
+	claims := jwt.MapClaims{}
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		if opts.Keys != nil && (kid != "" || opts.Key == nil) {
+			return opts.Keys.Key(kid, token.Method.Alg())
+		}
+		if opts.Key == nil {
+			return nil, errors.New("no key to verify the token with")
+		}
+		return opts.Key, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := validateClaims(MapClaims(claims), opts); err != nil {
+		return nil, err
+	}
+	return MapClaims(claims), nil
+}
+
+func validateClaims(claims MapClaims, opts VerifyOptions) error {
+	now := time.Now()
+	if exp, ok := claims.time("exp"); ok && now.After(exp.Add(opts.Leeway)) {
+		return errors.New("token is expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Before(nbf.Add(-opts.Leeway)) {
+		return errors.New("token is not valid yet")
+	}
+	if iat, ok := claims.time("iat"); ok && now.Before(iat.Add(-opts.Leeway)) {
+		return errors.New("token used before issued")
+	}
+	if opts.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != opts.Issuer {
+			return fmt.Errorf("unexpected issuer %q", iss)
+		}
+	}
+	if len(opts.Audience) > 0 && !claims.hasAudience(opts.Audience) {
+		return errors.New("token is not intended for this audience")
+	}
+	return nil
+}
+
+// time reads a NumericDate claim.
+func (c MapClaims) time(name string) (time.Time, bool) {
+	switch v := c[name].(type) {
+	case float64:
+		return time.Unix(int64(v), 0), true
+	case json.Number:
+		n, err := v.Int64()
+		return time.Unix(n, 0), err == nil
+	}
+	return time.Time{}, false
+}
+
+func (c MapClaims) hasAudience(accepted []string) bool {
+	var audience []string
+	switch v := c["aud"].(type) {
+	case string:
+		audience = []string{v}
+	case []interface{}:
+		for _, a := range v {
+			if s, ok := a.(string); ok {
+				audience = append(audience, s)
+			}
+		}
+	}
+	for _, a := range audience {
+		for _, b := range accepted {
+			if a == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func DecodeJWTNoVerify(tokenString string) (jwt.MapClaims, error) {
 	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
 	if err != nil {
@@ -83,6 +210,21 @@ func DecodeJWTNoVerify(tokenString string) (jwt.MapClaims, error) {
 	}
 }
 
+// SignJWT signs claims with the named algorithm. key is a []byte secret for
+// HMAC, otherwise an *rsa.PrivateKey, *ecdsa.PrivateKey or ed25519.PrivateKey.
+// kid is set as the key ID header when not empty.
+func SignJWT(claims MapClaims, alg string, key interface{}, kid string) (string, error) {
+	method := jwt.GetSigningMethod(alg)
+	if method == nil || method == jwt.SigningMethodNone {
+		return "", fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	token := jwt.NewWithClaims(method, jwt.MapClaims(claims))
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(key)
+}
+
 func GenerateJWT(username, secret string) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"id":  username,
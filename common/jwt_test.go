@@ -0,0 +1,162 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyJWTWithOptions(t *testing.T) {
+	secret := []byte("secret")
+	now := time.Now()
+	base := VerifyOptions{Algorithms: HMACAlgorithms, Key: secret}
+
+	tests := []struct {
+		name   string
+		claims MapClaims
+		alg    string
+		key    interface{}
+		opts   func(opts *VerifyOptions)
+		valid  bool
+	}{
+		{name: "valid", claims: MapClaims{"exp": now.Add(time.Hour).Unix()}, valid: true},
+		{name: "no time claims", claims: MapClaims{"sub": "alice"}, valid: true},
+		{name: "expired", claims: MapClaims{"exp": now.Add(-time.Minute).Unix()}},
+		{
+			name:   "expired within leeway",
+			claims: MapClaims{"exp": now.Add(-time.Minute).Unix()},
+			opts:   func(opts *VerifyOptions) { opts.Leeway = 2 * time.Minute },
+			valid:  true,
+		},
+		{name: "not valid yet", claims: MapClaims{"nbf": now.Add(time.Minute).Unix()}},
+		{
+			name:   "not valid yet within leeway",
+			claims: MapClaims{"nbf": now.Add(time.Minute).Unix()},
+			opts:   func(opts *VerifyOptions) { opts.Leeway = 2 * time.Minute },
+			valid:  true,
+		},
+		{name: "issued in the future", claims: MapClaims{"iat": now.Add(time.Minute).Unix()}},
+		{
+			name:   "issued in the future within leeway",
+			claims: MapClaims{"iat": now.Add(time.Minute).Unix()},
+			opts:   func(opts *VerifyOptions) { opts.Leeway = 2 * time.Minute },
+			valid:  true,
+		},
+		{
+			name:   "issuer",
+			claims: MapClaims{"iss": "auth"},
+			opts:   func(opts *VerifyOptions) { opts.Issuer = "auth" },
+			valid:  true,
+		},
+		{
+			name:   "wrong issuer",
+			claims: MapClaims{"iss": "other"},
+			opts:   func(opts *VerifyOptions) { opts.Issuer = "auth" },
+		},
+		{
+			name:   "missing issuer",
+			claims: MapClaims{},
+			opts:   func(opts *VerifyOptions) { opts.Issuer = "auth" },
+		},
+		{
+			name:   "audience string",
+			claims: MapClaims{"aud": "chat"},
+			opts:   func(opts *VerifyOptions) { opts.Audience = []string{"api", "chat"} },
+			valid:  true,
+		},
+		{
+			name:   "audience list",
+			claims: MapClaims{"aud": []string{"web", "chat"}},
+			opts:   func(opts *VerifyOptions) { opts.Audience = []string{"chat"} },
+			valid:  true,
+		},
+		{
+			name:   "wrong audience",
+			claims: MapClaims{"aud": []string{"web"}},
+			opts:   func(opts *VerifyOptions) { opts.Audience = []string{"chat"} },
+		},
+		{name: "wrong key", claims: MapClaims{}, key: []byte("other")},
+		{
+			name:   "algorithm not allowed",
+			claims: MapClaims{},
+			alg:    "HS512",
+			opts:   func(opts *VerifyOptions) { opts.Algorithms = []string{"HS256"} },
+		},
+		{
+			name:   "no algorithms",
+			claims: MapClaims{},
+			opts:   func(opts *VerifyOptions) { opts.Algorithms = nil },
+		},
+		{
+			name:   "no key",
+			claims: MapClaims{},
+			opts:   func(opts *VerifyOptions) { opts.Key = nil },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alg, key := tt.alg, tt.key
+			if alg == "" {
+				alg = "HS256"
+			}
+			if key == nil {
+				key = secret
+			}
+			token, err := SignJWT(tt.claims, alg, key, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts := base
+			if tt.opts != nil {
+				tt.opts(&opts)
+			}
+
+			_, err = VerifyJWTWithOptions(token, opts)
+			if tt.valid && err != nil {
+				t.Errorf("rejected: %v", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
+
+func TestVerifyJWT(t *testing.T) {
+	token, err := GenerateJWT("alice", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := VerifyJWT(token, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["id"] != "alice" {
+		t.Errorf("id = %v, want alice", claims["id"])
+	}
+	if _, err := VerifyJWT(token, "other"); err == nil {
+		t.Error("token was accepted with the wrong secret")
+	}
+}
@@ -0,0 +1,89 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is used by the server and client to report what they are doing.
+// Arguments after the message are alternating keys and values. A *slog.Logger
+// satisfies it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// NopLogger discards everything, it is the default Logger.
+var NopLogger Logger = nopLogger{}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+func (nopLogger) Error(string, ...any) {}
+
+// NewStdLogger returns a Logger writing lines such as
+// `level=INFO msg="connection added" uuid=abc` to a standard library logger,
+// log.Default() when l is nil.
+func NewStdLogger(l *log.Logger) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l}
+}
+
+type stdLogger struct {
+	*log.Logger
+}
+
+func (l *stdLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args) }
+func (l *stdLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args) }
+func (l *stdLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args) }
+func (l *stdLogger) Error(msg string, args ...any) { l.log("ERROR", msg, args) }
+
+func (l *stdLogger) log(level, msg string, args []any) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "level=%s msg=%q", level, msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%s", formatValue(args[i]))
+			break
+		}
+		fmt.Fprintf(&b, " %v=%s", args[i], formatValue(args[i+1]))
+	}
+	l.Print(b.String())
+}
+
+func formatValue(v any) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \"=\n") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
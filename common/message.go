@@ -24,14 +24,134 @@ package common
 
 import (
 	"encoding/json"
+	"fmt"
 )
 
 type Response struct {
 	EventName string      `json:"eventName"`
+	ID        string      `json:"id,omitempty"`
+	ReplyTo   string      `json:"replyTo,omitempty"`
+	Seq       uint64      `json:"seq,omitempty"`
 	Data      interface{} `json:"data"`
+	Error     *Error      `json:"error,omitempty"`
 }
 
+// Message is a decoded message. Data holds the payload still encoded with the
+// codec the message was decoded with. Seq is only set on messages sent by a
+// server with session resumption enabled.
+//
+// Data assigned directly must hold JSON, use SetData to encode a payload with
+// a binary codec. When a message is sent, Data is converted to the codec of
+// the connection if it was encoded with another one.
 type Message struct {
 	EventName string          `json:"eventName"`
+	ID        string          `json:"id,omitempty"`
+	ReplyTo   string          `json:"replyTo,omitempty"`
+	Seq       uint64          `json:"seq,omitempty"`
 	Data      json.RawMessage `json:"data"`
+	Error     *Error          `json:"error,omitempty"`
+
+	// Binary codec Data is encoded with, nil for JSON
+	dataCodec Codec
+}
+
+// SetData encodes payload into Data with codec.
+func (m *Message) SetData(codec Codec, payload interface{}) error {
+	data, err := codec.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	m.Data = data
+	m.dataCodec = nil
+	if codec.Binary() {
+		m.dataCodec = codec
+	}
+	return nil
+}
+
+// dataJSON returns Data encoded as JSON.
+func (m *Message) dataJSON() (json.RawMessage, error) {
+	if m.dataCodec == nil || len(m.Data) == 0 {
+		return m.Data, nil
+	}
+	var payload interface{}
+	if err := m.dataCodec.Unmarshal(m.Data, &payload); err != nil {
+		return nil, err
+	}
+	return json.Marshal(payload)
+}
+
+// withJSONData returns a copy of m whose Data is JSON.
+func (m *Message) withJSONData() (*Message, error) {
+	data, err := m.dataJSON()
+	if err != nil {
+		return nil, fmt.Errorf("failed to convert message data: %w", err)
+	}
+	converted := *m
+	converted.Data = data
+	converted.dataCodec = nil
+	return &converted, nil
+}
+
+// asMessage returns v as a *Message when it is a Message.
+func asMessage(v interface{}) (*Message, bool) {
+	switch m := v.(type) {
+	case *Message:
+		return m, m != nil
+	case Message:
+		return &m, true
+	}
+	return nil, false
+}
+
+// ResumeEvent is sent by the server when a connection opens, with ResumeInfo as
+// its data.
+const ResumeEvent = "sockets:resume"
+
+// ResumeInfo tells the client how to resume its session after a disconnect.
+// Token is presented on reconnect along with the last sequence number seen.
+type ResumeInfo struct {
+	Token string `json:"token"`
+	// Sequence number of the last message sent before this event.
+	Seq uint64 `json:"seq"`
+	// Whether this connection resumed a previous one.
+	Resumed bool `json:"resumed"`
+	// False when messages were missed because they no longer fit the buffer.
+	Complete bool `json:"complete"`
+}
+
+// ErrorEvent is the event errors are sent to the client with. The message
+// replies to the failed message, so a pending call receives it as its reply.
+const ErrorEvent = "sockets:error"
+
+// Codes of the errors sent by the server.
+const (
+	CodeUnknownEvent   = "unknown_event"
+	CodeUnauthorized   = "unauthorized"
+	CodeForbidden      = "forbidden"
+	CodeBadRequest     = "bad_request"
+	CodeInvalidPayload = "invalid_payload"
+	CodeRateLimited    = "rate_limited"
+	CodeUnsupported    = "unsupported"
+	CodeHandler        = "handler_error"
+	CodeInternal       = "internal_error"
+)
+
+// Error is sent in place of data when a request could not be handled. Event
+// and ID identify the failed message, they are filled in by the server.
+// Details optionally carries structured information, such as the problems
+// found when validating a payload.
+type Error struct {
+	Code    string      `json:"code,omitempty"`
+	Message string      `json:"message"`
+	Event   string      `json:"event,omitempty"`
+	ID      string      `json:"id,omitempty"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return e.Message
+	}
+	return e.Code + ": " + e.Message
 }
@@ -0,0 +1,302 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+var errMsgPackShort = errors.New("msgpack: unexpected end of data")
+
+// msgPackEncoder writes values in the MessagePack format.
+type msgPackEncoder struct {
+	buf *bytes.Buffer
+}
+
+func newMsgPackEncoder(buf *bytes.Buffer) binaryEncoder {
+	return msgPackEncoder{buf: buf}
+}
+
+func (e msgPackEncoder) writeNil() {
+	e.buf.WriteByte(0xc0)
+}
+
+func (e msgPackEncoder) writeBool(b bool) {
+	if b {
+		e.buf.WriteByte(0xc3)
+	} else {
+		e.buf.WriteByte(0xc2)
+	}
+}
+
+func (e msgPackEncoder) writeInt(n int64) {
+	msgPackInt(e.buf, n)
+}
+
+func (e msgPackEncoder) writeUint(n uint64) {
+	msgPackUint(e.buf, n)
+}
+
+func (e msgPackEncoder) writeFloat(f float64) {
+	e.buf.WriteByte(0xcb)
+	binary.Write(e.buf, binary.BigEndian, math.Float64bits(f))
+}
+
+func (e msgPackEncoder) writeString(s string) {
+	msgPackHeader(e.buf, len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	e.buf.WriteString(s)
+}
+
+func (e msgPackEncoder) writeBytes(b []byte) {
+	msgPackHeader(e.buf, len(b), 0, 0, 0xc4, 0xc5, 0xc6)
+	e.buf.Write(b)
+}
+
+func (e msgPackEncoder) writeArrayHeader(n int) {
+	msgPackHeader(e.buf, n, 0x90, 15, 0, 0xdc, 0xdd)
+}
+
+func (e msgPackEncoder) writeMapHeader(n int) {
+	msgPackHeader(e.buf, n, 0x80, 15, 0, 0xde, 0xdf)
+}
+
+func (e msgPackEncoder) writeRaw(b []byte) {
+	e.buf.Write(b)
+}
+
+// msgPackHeader writes a length prefixed header. The fix format is used when
+// n <= fixMax, a zero code means the format has no variant of that size.
+func msgPackHeader(buf *bytes.Buffer, n int, fix byte, fixMax int, code8, code16, code32 byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		buf.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		buf.WriteByte(code8)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(code16)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(code32)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func msgPackInt(buf *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0:
+		msgPackUint(buf, uint64(n))
+	case n >= -32:
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(n))
+	case n >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(n))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func msgPackUint(buf *bytes.Buffer, n uint64) {
+	switch {
+	case n <= 0x7f:
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+type msgPackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func newMsgPackDecoder(data []byte) binaryDecoder {
+	return &msgPackDecoder{data: data}
+}
+
+func (d *msgPackDecoder) name() string {
+	return "msgpack"
+}
+
+func (d *msgPackDecoder) offset() int {
+	return d.pos
+}
+
+// atBreak is always false, MessagePack has no indefinite lengths.
+func (d *msgPackDecoder) atBreak() bool {
+	return false
+}
+
+func (d *msgPackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgPackShort
+	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// uint reads a big endian unsigned integer of size bytes.
+func (d *msgPackDecoder) uint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *msgPackDecoder) next() (binaryItem, error) {
+	b, err := d.read(1)
+	if err != nil {
+		return binaryItem{}, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return binaryItem{kind: itemInt, i: int64(code)}, nil
+	case code >= 0xe0:
+		return binaryItem{kind: itemInt, i: int64(int8(code))}, nil
+	case code >= 0xa0 && code <= 0xbf:
+		return d.str(itemString, uint64(code&0x1f))
+	case code >= 0x90 && code <= 0x9f:
+		return d.array(uint64(code & 0x0f))
+	case code >= 0x80 && code <= 0x8f:
+		return d.dict(uint64(code & 0x0f))
+	}
+
+	switch code {
+	case 0xc0:
+		return binaryItem{kind: itemNil}, nil
+	case 0xc2, 0xc3:
+		return binaryItem{kind: itemBool, b: code == 0xc3}, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.uint(1 << (code - 0xc4))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return d.str(itemBytes, n)
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return binaryItem{kind: itemFloat, f: float64(math.Float32frombits(uint32(n)))}, nil
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return binaryItem{kind: itemFloat, f: math.Float64frombits(n)}, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (code - 0xcc))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		if n <= math.MaxInt64 {
+			return binaryItem{kind: itemInt, i: int64(n)}, nil
+		}
+		return binaryItem{kind: itemUint, u: n}, nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (code - 0xd0)
+		n, err := d.uint(size)
+		if err != nil {
+			return binaryItem{}, err
+		}
+		// Sign extend from the encoded size
+		shift := uint(64 - size*8)
+		return binaryItem{kind: itemInt, i: int64(n<<shift) >> shift}, nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.uint(1 << (code - 0xd9))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return d.str(itemString, n)
+	case 0xdc, 0xdd:
+		n, err := d.uint(2 << (code - 0xdc))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return d.array(n)
+	case 0xde, 0xdf:
+		n, err := d.uint(2 << (code - 0xde))
+		if err != nil {
+			return binaryItem{}, err
+		}
+		return d.dict(n)
+	}
+
+	return binaryItem{}, fmt.Errorf("msgpack: unsupported format 0x%02x", code)
+}
+
+func (d *msgPackDecoder) str(kind itemKind, n uint64) (binaryItem, error) {
+	if n > uint64(len(d.data)-d.pos) {
+		return binaryItem{}, errMsgPackShort
+	}
+	b, err := d.read(int(n))
+	if err != nil {
+		return binaryItem{}, err
+	}
+	return binaryItem{kind: kind, s: b}, nil
+}
+
+func (d *msgPackDecoder) array(n uint64) (binaryItem, error) {
+	// Every element takes at least one byte
+	if n > uint64(len(d.data)-d.pos) {
+		return binaryItem{}, errMsgPackShort
+	}
+	return binaryItem{kind: itemArray, n: int(n)}, nil
+}
+
+func (d *msgPackDecoder) dict(n uint64) (binaryItem, error) {
+	// Every entry takes at least two bytes
+	if n > uint64(len(d.data)-d.pos)/2 {
+		return binaryItem{}, errMsgPackShort
+	}
+	return binaryItem{kind: itemMap, n: int(n)}, nil
+}
@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package common
+
+import "fmt"
+
+// Protocol is a websocket subprotocol: a version of the wire format paired
+// with the codec used to encode it.
+type Protocol struct {
+	Version int
+	Codec   Codec
+}
+
+// DefaultProtocol is spoken with peers that don't negotiate a subprotocol.
+var DefaultProtocol = Protocol{Version: 1, Codec: JSON}
+
+// Name returns the subprotocol name, for example "sockets.v1.json".
+func (p Protocol) Name() string {
+	return fmt.Sprintf("sockets.v%d.%s", p.Version, p.Codec.Name())
+}
+
+// ProtocolsFor returns version 1 of the protocol for each codec.
+func ProtocolsFor(codecs []Codec) []Protocol {
+	protocols := make([]Protocol, 0, len(codecs))
+	for _, codec := range codecs {
+		protocols = append(protocols, Protocol{Version: 1, Codec: codec})
+	}
+	return protocols
+}
+
+// ProtocolNames returns the subprotocol names of protocols.
+func ProtocolNames(protocols []Protocol) []string {
+	names := make([]string, 0, len(protocols))
+	for _, p := range protocols {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// FindProtocol returns the protocol of protocols negotiated as subprotocol,
+// or DefaultProtocol when none matches.
+func FindProtocol(protocols []Protocol, subprotocol string) Protocol {
+	for _, p := range protocols {
+		if p.Name() == subprotocol {
+			return p
+		}
+	}
+	return DefaultProtocol
+}
@@ -22,7 +22,25 @@
 
 package sockets
 
-import "time"
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/syleron/sockets/common"
+)
+
+// QueueFullPolicy decides what Emit does when a connection's outbound queue is full.
+type QueueFullPolicy int
+
+const (
+	// QueueDropNewest discards the message being emitted.
+	QueueDropNewest QueueFullPolicy = iota
+	// QueueDropOldest discards the oldest queued message to make room.
+	QueueDropOldest
+	// QueueDisconnect closes the connection of the slow consumer.
+	QueueDisconnect
+)
 
 type Config struct {
 	// Time allowed to write a message to the peer.
@@ -33,6 +51,74 @@ type Config struct {
 	PingPeriod time.Duration
 	// Maximum message size allowed from peer.
 	ReadLimitSize int64
+	// Maximum number of outbound messages queued per connection.
+	SendQueueSize int
+	// What to do when a connection's outbound queue is full.
+	QueueFullPolicy QueueFullPolicy
+	// Protocols advertised to clients as websocket subprotocols, in order of
+	// preference. Clients that don't request one speak common.DefaultProtocol.
+	Protocols []common.Protocol
+	// Shorthand for advertising version 1 of the protocol for each codec,
+	// only used when Protocols is empty.
+	Codecs []common.Codec
+	// Negotiate permessage-deflate compression with clients that support it.
+	EnableCompression bool
+	// Compression level from -2 (huffman only) to 9, zero uses the default level.
+	CompressionLevel int
+	// Messages smaller than this many bytes are sent uncompressed.
+	CompressionThreshold int
+	// Origins allowed to open a websocket, either exact ("https://example.com")
+	// or any subdomain ("https://*.example.com"). Exact origins include the
+	// port, "https://example.com" doesn't allow "https://example.com:8443".
+	// Subdomain rules allow any port unless one is given
+	// ("https://*.example.com:8443"). When no origin rules are configured
+	// every origin is allowed.
+	AllowedOrigins []string
+	// Regular expressions matched against the whole lower cased origin
+	// including the scheme, e.g. `https://[a-z]+\.example\.com`. Patterns are
+	// anchored, so `example\.com` doesn't allow "https://example.com.evil.net".
+	AllowedOriginPatterns []*regexp.Regexp
+	// Custom check consulted for origins not matched by the rules above.
+	CheckOrigin func(r *http.Request) bool
+	// Called whenever an upgrade is refused because of its origin.
+	OnOriginRejected func(r *http.Request, origin string)
+	// Authenticates upgrade requests, the connection then joins the session
+	// of the authenticated user. Nil accepts every request.
+	Authenticator Authenticator
+	// How long before an authenticated connection's token expires the client
+	// is sent common.TokenExpiringEvent. Connections that don't re-authenticate
+	// with common.ReauthEvent in time are closed with common.CloseTokenExpired.
+	TokenExpiryWarning time.Duration
+	// Called before an error is sent to a client with common.ErrorEvent. It
+	// may return a different error, or nil to send nothing.
+	OnError func(ctx *Context, err *common.Error) *common.Error
+	// Rate limits applied to incoming events, nil disables rate limiting.
+	// Messages that can't be decoded count against them too.
+	RateLimit *RateLimit
+	// Consecutive undecodable messages tolerated before the connection is
+	// closed with websocket.CloseUnsupportedData. Negative disables the limit.
+	MaxMalformedMessages int
+	// Track which users are in which rooms and emit presence events to room
+	// members. Presence is shared with the other nodes through the Adapter.
+	Presence bool
+	// Keep disconnected connections around so clients can resume them, nil
+	// disables session resumption.
+	Resume *ResumeConfig
+	// Relays broadcasts to the other nodes of a cluster, nil keeps them local.
+	Adapter Adapter
+	// Receives the server's logs, *slog.Logger can be used directly. Nothing
+	// is logged when nil.
+	Logger common.Logger
+	// Receives instrumentation events, nil disables metrics.
+	Metrics Metrics
+	// Gracefully shut down on SIGINT. The process keeps running, use
+	// OnShutdown to stop the rest of the application.
+	HandleSignals bool
+	// Time allowed for a signal triggered shutdown to drain connections.
+	ShutdownTimeout time.Duration
+	// Called once a signal triggered shutdown finished, with the error
+	// returned by Shutdown.
+	OnShutdown func(err error)
 }
 
 // MergeDefaults sets the uninitialized fields in the config with default values.
@@ -50,14 +136,51 @@ func (c *Config) MergeDefaults() {
 	if c.ReadLimitSize == 0 {
 		c.ReadLimitSize = defaults.ReadLimitSize
 	}
+	if c.SendQueueSize == 0 {
+		c.SendQueueSize = defaults.SendQueueSize
+	}
+	if len(c.Codecs) == 0 {
+		c.Codecs = defaults.Codecs
+	}
+	if len(c.Protocols) == 0 {
+		c.Protocols = common.ProtocolsFor(c.Codecs)
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = defaults.ShutdownTimeout
+	}
+	if c.TokenExpiryWarning == 0 {
+		c.TokenExpiryWarning = defaults.TokenExpiryWarning
+	}
+	if c.MaxMalformedMessages == 0 {
+		c.MaxMalformedMessages = defaults.MaxMalformedMessages
+	}
+	if c.Logger == nil {
+		c.Logger = common.NopLogger
+	}
+	if c.Metrics == nil {
+		c.Metrics = noopMetrics{}
+	}
+	if c.Resume != nil {
+		if c.Resume.GracePeriod == 0 {
+			c.Resume.GracePeriod = 30 * time.Second
+		}
+		if c.Resume.BufferSize == 0 {
+			c.Resume.BufferSize = 256
+		}
+	}
 }
 
 // DefaultConfig returns a configuration with default settings.
 func DefaultConfig() Config {
 	c := Config{
-		WriteWait:     10 * time.Second,
-		PongWait:      60 * time.Second,
-		ReadLimitSize: 2560,
+		WriteWait:            10 * time.Second,
+		PongWait:             60 * time.Second,
+		ReadLimitSize:        2560,
+		SendQueueSize:        256,
+		Codecs:               []common.Codec{common.JSON},
+		ShutdownTimeout:      10 * time.Second,
+		TokenExpiryWarning:   time.Minute,
+		MaxMalformedMessages: 10,
 	}
 	c.PingPeriod = (c.PongWait * 9) / 10
 	return c
@@ -23,22 +23,58 @@
 package sockets
 
 import (
+	"errors"
 	"github.com/gorilla/websocket"
 	"github.com/rs/xid"
+	"github.com/syleron/sockets/common"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	// ErrQueueFull is returned by Emit when the outbound queue is full and the
+	// message was dropped.
+	ErrQueueFull = errors.New("outbound queue is full")
+	// ErrSlowConsumer is returned by Emit when the connection was disconnected
+	// because it could not keep up with its outbound queue.
+	ErrSlowConsumer = errors.New("connection closed: slow consumer")
+	// ErrConnectionClosed is returned by Emit once the connection has closed.
+	ErrConnectionClosed = errors.New("connection is closed")
+)
+
 type Connection struct {
 	UUID   string
 	Conn   *websocket.Conn
-	Status bool  `json:"status"`
-	Room   *Room `json:"room"`
+	Status bool `json:"status"`
 	Data   map[string]interface{}
 	//The connection Source address determined by the user.
 	RealIP string
 	sync.RWMutex
 	*Session
+
+	// Room name to the set of channels joined within that room
+	rooms map[string]map[string]bool
+
+	send      chan outbound
+	closeMsg  chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	config    *Config
+	server    *Sockets
+	protocol  common.Protocol
+	limiter   *connectionLimiter
+	identity  *Identity
+	// Fires when the identity's token is about to expire and once it has
+	expiryTimer *time.Timer
+
+	// Session resumption state, only set when Config.Resume is enabled
+	replay      *replayBuffer
+	resumeToken string
+	parkTimer   *time.Timer
+	parked      int32
+	// Set once the server decided to close the connection
+	closedByServer int32
 }
 
 func NewConnection() *Connection {
@@ -47,28 +83,116 @@ func NewConnection() *Connection {
 
 	return &Connection{
 		UUID: uuid,
-		Room: &Room{
-			Name:    "",
-			Channel: "",
-		},
 		Session: &Session{
 			Username:    "",
 			connections: nil,
 			Mutex:       sync.Mutex{},
 		},
-		Data: map[string]interface{}{},
+		Data:     map[string]interface{}{},
+		rooms:    make(map[string]map[string]bool),
+		closeMsg: make(chan []byte, 1),
+		done:     make(chan struct{}),
 	}
 }
 
+// outbound is a message waiting in the queue of the write pump.
+type outbound struct {
+	msg      interface{}
+	compress bool
+}
+
+// Emit queues a message for delivery by the connection's write pump. When the
+// queue is full the configured QueueFullPolicy decides what happens.
 func (c *Connection) Emit(msg interface{}) error {
-	// We are sending this to a single user
-	// but on multiple connections.
-	if err := c.Conn.WriteJSON(msg); err != nil {
+	return c.enqueue(outbound{msg: msg, compress: true})
+}
+
+// EmitUncompressed is like Emit but never compresses the message, useful for
+// payloads that are already compressed.
+func (c *Connection) EmitUncompressed(msg interface{}) error {
+	return c.enqueue(outbound{msg: msg})
+}
+
+func (c *Connection) enqueue(msg outbound) error {
+	if c.replay != nil {
+		msg = c.replay.record(msg)
+	}
+	if err := c.push(msg); err != nil {
+		c.metrics().MessageDropped(eventName(msg.msg), dropReason(err))
 		return err
 	}
 	return nil
 }
 
+// push queues msg for the write pump without recording it for replay.
+func (c *Connection) push(msg outbound) error {
+	select {
+	case <-c.done:
+		// A parked connection still buffers messages for when it resumes
+		if atomic.LoadInt32(&c.parked) == 1 {
+			return nil
+		}
+		return ErrConnectionClosed
+	default:
+	}
+
+	select {
+	case c.send <- msg:
+		return nil
+	default:
+		return c.queueFull(msg)
+	}
+}
+
+func (c *Connection) queueFull(msg outbound) error {
+	policy := QueueDropNewest
+	if c.config != nil {
+		policy = c.config.QueueFullPolicy
+	}
+
+	switch policy {
+	case QueueDropOldest:
+		for {
+			// Make room by discarding the oldest queued message
+			select {
+			case oldest := <-c.send:
+				c.metrics().MessageDropped(eventName(oldest.msg), DropOldest)
+			default:
+			}
+			select {
+			case c.send <- msg:
+				return nil
+			case <-c.done:
+				return ErrConnectionClosed
+			default:
+			}
+		}
+	case QueueDisconnect:
+		c.close()
+		return ErrSlowConsumer
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Protocol returns the subprotocol negotiated for the connection.
+func (c *Connection) Protocol() common.Protocol {
+	if c.protocol.Codec == nil {
+		return common.DefaultProtocol
+	}
+	return c.protocol
+}
+
+// ProtocolVersion returns the wire format version spoken by the client.
+func (c *Connection) ProtocolVersion() int {
+	return c.Protocol().Version
+}
+
+// Codec returns the codec negotiated for the connection.
+func (c *Connection) Codec() common.Codec {
+	return c.Protocol().Codec
+}
+
 func (c *Connection) SetData(key string, value interface{}) {
 	c.Lock()
 	defer c.Unlock()
@@ -81,35 +205,131 @@ func (c *Connection) GetData(key string) interface{} {
 	return c.Data[key]
 }
 
+// ClearSession detaches the connection from its session. The connection
+// leaves the presence of its rooms, and the session is deleted once it has no
+// connections left.
 func (c *Connection) ClearSession() {
-	c.Session = nil
+	if c.server == nil {
+		c.Session = nil
+		return
+	}
+	c.server.clearSession(c)
 }
 
 func (c *Connection) addSession(session *Session) {
 	c.Session = session
 }
 
-func (c *Connection) pongHandler(pingPeriod time.Duration) {
-	ticker := time.NewTicker(pingPeriod)
+// startWritePump allocates the outbound queue and starts the goroutine that
+// owns all writes to the underlying websocket.
+func (c *Connection) startWritePump(config *Config) {
+	c.config = config
+	if c.send == nil {
+		c.send = make(chan outbound, config.SendQueueSize)
+	}
+	go c.writePump()
+}
+
+// write encodes and writes msg to the websocket. Only the write pump may call
+// it once the pump is running.
+func (c *Connection) write(msg outbound) error {
+	event := eventName(msg.msg)
+	data, err := c.Codec().Marshal(msg.msg)
+	if err != nil {
+		c.logger().Error("failed to encode message", c.logArgs("event", event, "error", err)...)
+		c.metrics().MessageDropped(event, DropEncodeError)
+		return nil
+	}
+	// Compression only applies if it was negotiated during the handshake
+	c.Conn.EnableWriteCompression(msg.compress && len(data) >= c.config.CompressionThreshold)
+	c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+	if err := c.Conn.WriteMessage(frameType(c.Codec()), data); err != nil {
+		c.metrics().MessageDropped(event, DropWriteError)
+		return err
+	}
+	c.metrics().MessageSent(event, len(data))
+	return nil
+}
+
+// writePump is the only goroutine allowed to write to the websocket, gorilla
+// does not support concurrent writers. Queued messages and pings both go
+// through here.
+func (c *Connection) writePump() {
+	ticker := time.NewTicker(c.config.PingPeriod)
 
 	defer func() {
 		// Set our connection state
 		c.Status = false
 		// Stop our ticker
 		ticker.Stop()
-		// Close our connection
-		// TODO: This may cause issues as it may not clear up our connections array
+		// Closing the socket unblocks the read loop which cleans up the connection
 		c.Conn.Close()
 	}()
 
 	for {
 		select {
+		case msg := <-c.send:
+			if err := c.write(msg); err != nil {
+				return
+			}
 		// Send a ping message depicted by our ticker
 		case <-ticker.C:
-			// Periodically send a ping message
+			c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, []byte{}); err != nil {
 				return
 			}
+		case data := <-c.closeMsg:
+			c.Conn.SetWriteDeadline(time.Now().Add(c.config.WriteWait))
+			if err := c.Conn.WriteMessage(websocket.CloseMessage, data); err != nil {
+				return
+			}
+			// Give the peer a chance to answer the close handshake
+			select {
+			case <-c.done:
+			case <-time.After(c.config.WriteWait):
+			}
+			return
+		case <-c.done:
+			return
 		}
 	}
 }
+
+// closeWithCode asks the write pump to send a close frame to the peer. The
+// connection is torn down once the peer answers or WriteWait elapses.
+func (c *Connection) closeWithCode(code int, text string) {
+	atomic.StoreInt32(&c.closedByServer, 1)
+	select {
+	case c.closeMsg <- websocket.FormatCloseMessage(code, text):
+	default:
+	}
+}
+
+// close stops the write pump, which in turn closes the websocket.
+func (c *Connection) close() {
+	atomic.StoreInt32(&c.closedByServer, 1)
+	c.closeOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// logger returns the logger of the connection's server.
+func (c *Connection) logger() common.Logger {
+	if c.config == nil || c.config.Logger == nil {
+		return common.NopLogger
+	}
+	return c.config.Logger
+}
+
+// logArgs prefixes args with the fields identifying the connection.
+func (c *Connection) logArgs(args ...any) []any {
+	return append([]any{"uuid", c.UUID, "username", connectionUsername(c), "remote_ip", c.RealIP}, args...)
+}
+
+// frameType returns the websocket frame type used for messages of codec.
+func frameType(codec common.Codec) int {
+	if codec.Binary() {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
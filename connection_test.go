@@ -0,0 +1,111 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/syleron/sockets/common"
+)
+
+func TestQueueFullPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy QueueFullPolicy
+		err    error
+		queued string
+		closed bool
+	}{
+		{"drop newest", QueueDropNewest, ErrQueueFull, "first", false},
+		{"drop oldest", QueueDropOldest, nil, "second", false},
+		{"disconnect", QueueDisconnect, ErrSlowConsumer, "first", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := NewConnection()
+			conn.config = &Config{QueueFullPolicy: tt.policy}
+			conn.send = make(chan outbound, 1)
+
+			if err := conn.Emit("first"); err != nil {
+				t.Fatalf("first Emit: %v", err)
+			}
+			if err := conn.Emit("second"); !errors.Is(err, tt.err) {
+				t.Fatalf("second Emit = %v, want %v", err, tt.err)
+			}
+			if got := (<-conn.send).msg; got != tt.queued {
+				t.Errorf("queued %v, want %v", got, tt.queued)
+			}
+
+			select {
+			case <-conn.done:
+				if !tt.closed {
+					t.Error("connection closed")
+				}
+			default:
+				if tt.closed {
+					t.Error("connection not closed")
+				}
+			}
+		})
+	}
+}
+
+func TestEmitAfterClose(t *testing.T) {
+	conn := NewConnection()
+	conn.send = make(chan outbound, 1)
+	conn.close()
+
+	if err := conn.Emit("late"); !errors.Is(err, ErrConnectionClosed) {
+		t.Fatalf("Emit = %v, want %v", err, ErrConnectionClosed)
+	}
+}
+
+func TestWritePumpConcurrentEmit(t *testing.T) {
+	_, handler, url := newTestServer(t, &Config{SendQueueSize: 512})
+	ws := dialTestServer(t, url)
+	ctx := <-handler.opened
+
+	const writers, messages = 8, 50
+	for w := 0; w < writers; w++ {
+		go func(w int) {
+			for i := 0; i < messages; i++ {
+				ctx.Emit(common.Response{EventName: "count", Data: fmt.Sprint(w, i)})
+			}
+		}(w)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < writers*messages; i++ {
+		var msg common.Message
+		if err := ws.ReadJSON(&msg); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if msg.EventName != "count" {
+			t.Fatalf("message %d has event %q", i, msg.EventName)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"crypto/x509"
+	"errors"
+
+	"github.com/syleron/sockets/common"
+)
+
+type Context struct {
+	*Connection
+	UUID      string
+	PeerCerts []*x509.Certificate
+	message   *common.Message
+}
+
+// withMessage returns a copy of the context bound to the message being handled.
+func (ctx *Context) withMessage(msg *common.Message) *Context {
+	c := *ctx
+	c.message = msg
+	return &c
+}
+
+// Message returns the message being handled, or nil outside of an event handler.
+func (ctx *Context) Message() *common.Message {
+	return ctx.message
+}
+
+// Decode decodes the data of the message being handled into v using the
+// connection's codec.
+func (ctx *Context) Decode(v interface{}) error {
+	if ctx.message == nil {
+		return errors.New("no message to decode")
+	}
+	return ctx.Codec().Unmarshal(ctx.message.Data, v)
+}
+
+// Reply sends data back to the client as the response to the message being
+// handled. The response carries the message ID so the client can match it.
+func (ctx *Context) Reply(data interface{}) error {
+	if ctx.message == nil {
+		return errors.New("no message to reply to")
+	}
+	return ctx.Emit(common.Response{
+		EventName: ctx.message.EventName,
+		ReplyTo:   ctx.message.ID,
+		Data:      data,
+	})
+}
+
+// ReplyError sends err back to the client as a common.ErrorEvent replying to
+// the message being handled. A *common.Error keeps its code and details,
+// other errors are sent with common.CodeHandler.
+func (ctx *Context) ReplyError(err error) error {
+	if ctx.message == nil {
+		return errors.New("no message to reply to")
+	}
+	var replyErr *common.Error
+	if !errors.As(err, &replyErr) {
+		replyErr = &common.Error{Code: common.CodeHandler, Message: err.Error()}
+	}
+	return ctx.sendError(replyErr)
+}
+
+// sendError emits err as a common.ErrorEvent, identifying the message being
+// handled if there is one. Config.OnError may replace or suppress it.
+func (ctx *Context) sendError(err *common.Error) error {
+	envelope := *err
+	replyTo := ""
+	if ctx.message != nil {
+		envelope.Event = ctx.message.EventName
+		envelope.ID = ctx.message.ID
+		replyTo = ctx.message.ID
+	}
+
+	sent := &envelope
+	if ctx.config != nil && ctx.config.OnError != nil {
+		if sent = ctx.config.OnError(ctx, sent); sent == nil {
+			return nil
+		}
+	}
+	return ctx.Emit(common.Response{
+		EventName: common.ErrorEvent,
+		ReplyTo:   replyTo,
+		Error:     sent,
+	})
+}
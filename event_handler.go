@@ -23,34 +23,96 @@
 package sockets
 
 import (
-	"fmt"
+	"sync"
+	"time"
 
 	"github.com/syleron/sockets/common"
 )
 
-var events map[string]*Event
-
 type Event struct {
-	Protected bool
-	EventFunc EventFunc
+	Protected  bool
+	EventFunc  EventFunc
+	Middleware []Middleware
 }
 
 type EventFunc func(msg *common.Message, ctx *Context)
 
-func EventHandler(msg *common.Message, ctx *Context) {
-	event := events[msg.EventName]
-	if event != nil {
-		// Check to see if we are protected
-		if event.Protected {
-			if ctx.HasSession() {
-				event.EventFunc(msg, ctx)
-			} else {
-				fmt.Print("protected " + msg.EventName + " event called, however, no session has been set. Handler dropped. " + ctx.UUID)
-			}
-		} else {
-			event.EventFunc(msg, ctx)
-		}
-	} else {
-		fmt.Print("event " + msg.EventName + " does not have an event handler")
+// eventRegistry holds the event handlers of a single Sockets instance. It is
+// safe to register and remove handlers while events are being dispatched.
+type eventRegistry struct {
+	events     map[string]*Event
+	middleware []Middleware
+	sync.RWMutex
+}
+
+func newEventRegistry() *eventRegistry {
+	return &eventRegistry{
+		events: make(map[string]*Event),
+	}
+}
+
+func (r *eventRegistry) add(pattern string, event *Event) {
+	r.Lock()
+	defer r.Unlock()
+	r.events[pattern] = event
+}
+
+func (r *eventRegistry) remove(pattern string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.events, pattern)
+}
+
+func (r *eventRegistry) use(middleware ...Middleware) {
+	r.Lock()
+	defer r.Unlock()
+	r.middleware = append(r.middleware, middleware...)
+}
+
+// label returns the event name to report to Metrics, unregistered events are
+// collapsed into "unknown".
+func (r *eventRegistry) label(pattern string) string {
+	r.RLock()
+	defer r.RUnlock()
+	if _, ok := r.events[pattern]; !ok {
+		return "unknown"
+	}
+	return pattern
+}
+
+// get returns the event registered for pattern along with the global
+// middleware that applies to it.
+func (r *eventRegistry) get(pattern string) (*Event, []Middleware) {
+	r.RLock()
+	defer r.RUnlock()
+	return r.events[pattern], r.middleware
+}
+
+func (s *Sockets) EventHandler(msg *common.Message, ctx *Context) {
+	event, middleware := s.events.get(msg.EventName)
+	if event == nil {
+		s.config.Logger.Warn("event does not have an event handler", ctx.logArgs("event", msg.EventName)...)
+		ctx.sendError(&common.Error{Code: common.CodeUnknownEvent, Message: "event " + msg.EventName + " does not have an event handler"})
+		return
+	}
+
+	// Global middleware runs first, then the protected check, then the
+	// middleware registered with the event itself.
+	handler := chain(event.EventFunc, event.Middleware)
+	handler = chain(event.protect(handler), middleware)
+
+	start := time.Now()
+	defer func() {
+		s.config.Metrics.EventHandled(msg.EventName, time.Since(start))
+	}()
+	// A panicking handler must not take down the connection's read loop
+	defer recoverPanic(msg, ctx)
+	handler(msg, ctx)
+}
+
+func (e *Event) protect(next EventFunc) EventFunc {
+	if !e.Protected {
+		return next
 	}
+	return RequireSession()(next)
 }
@@ -53,6 +53,7 @@ func main() {
 		PongWait:      60 * time.Second,
 		PingPeriod:    54 * time.Second, // 90% of PongWait
 		ReadLimitSize: 512,
+		Logger:        common.NewStdLogger(nil),
 	}
 	// Setup socket server with proper configuration
 	ws = sockets.New(&SocketHandler{}, config)
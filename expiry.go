@@ -0,0 +1,126 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"time"
+
+	"github.com/syleron/sockets/common"
+)
+
+// scheduleExpiry arranges for the client to be warned ahead of its token
+// expiring and for the connection to be closed once it has.
+func (s *Sockets) scheduleExpiry(conn *Connection) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.expiryTimer != nil {
+		conn.expiryTimer.Stop()
+		conn.expiryTimer = nil
+	}
+	identity := conn.identity
+	if identity == nil || identity.ExpiresAt.IsZero() {
+		return
+	}
+	warnAt := identity.ExpiresAt.Add(-s.config.TokenExpiryWarning)
+	conn.expiryTimer = time.AfterFunc(time.Until(warnAt), func() {
+		s.tokenExpiring(conn, identity)
+	})
+}
+
+// stopExpiry cancels the pending expiry of the connection's token.
+func (s *Sockets) stopExpiry(conn *Connection) {
+	conn.Lock()
+	defer conn.Unlock()
+
+	if conn.expiryTimer != nil {
+		conn.expiryTimer.Stop()
+		conn.expiryTimer = nil
+	}
+}
+
+func (s *Sockets) tokenExpiring(conn *Connection, identity *Identity) {
+	conn.Lock()
+	if conn.identity != identity {
+		// The client re-authenticated in the meantime
+		conn.Unlock()
+		return
+	}
+	conn.expiryTimer = time.AfterFunc(time.Until(identity.ExpiresAt), func() {
+		s.tokenExpired(conn, identity)
+	})
+	conn.Unlock()
+
+	conn.Emit(common.Response{
+		EventName: common.TokenExpiringEvent,
+		Data:      common.TokenExpiry{ExpiresAt: identity.ExpiresAt},
+	})
+}
+
+func (s *Sockets) tokenExpired(conn *Connection, identity *Identity) {
+	conn.RLock()
+	current := conn.identity
+	conn.RUnlock()
+	if current != identity {
+		return
+	}
+
+	s.config.Logger.Info("closing connection with expired token", conn.logArgs()...)
+	conn.closeWithCode(common.CloseTokenExpired, "token expired")
+}
+
+// handleReauth replaces the identity of the connection with the one of a
+// fresh token sent by the client. The token must belong to the same user.
+func (s *Sockets) handleReauth(msg *common.Message, ctx *Context) {
+	authenticator, ok := s.config.Authenticator.(TokenAuthenticator)
+	if !ok {
+		ctx.ReplyError(&common.Error{Code: common.CodeUnsupported, Message: "re-authentication is not supported"})
+		return
+	}
+
+	var req common.Reauth
+	if err := ctx.Decode(&req); err != nil || req.Token == "" {
+		ctx.ReplyError(&common.Error{Code: common.CodeBadRequest, Message: "missing token"})
+		return
+	}
+
+	identity, err := authenticator.AuthenticateToken(req.Token)
+	if err != nil {
+		ctx.ReplyError(&common.Error{Code: common.CodeUnauthorized, Message: err.Error()})
+		return
+	}
+	if identity.Username != connectionUsername(ctx.Connection) {
+		ctx.ReplyError(&common.Error{Code: common.CodeUnauthorized, Message: "token belongs to another user"})
+		return
+	}
+
+	ctx.Lock()
+	ctx.identity = identity
+	ctx.Unlock()
+	if ctx.Session != nil {
+		ctx.Session.setIdentity(identity)
+	}
+	s.scheduleExpiry(ctx.Connection)
+
+	ctx.Reply(common.TokenExpiry{ExpiresAt: identity.ExpiresAt})
+}
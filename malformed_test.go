@@ -0,0 +1,141 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+// receivedMetrics records the labels of the messages received.
+type receivedMetrics struct {
+	noopMetrics
+	events []string
+	sync.Mutex
+}
+
+func (m *receivedMetrics) MessageReceived(event string, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.events = append(m.events, event)
+}
+
+func TestMalformedMessages(t *testing.T) {
+	const valid, garbage = `{"eventName":"missing"}`, "\x00garbage"
+
+	// step sends data and expects an error with code in reply, or the
+	// connection to close with websocket.CloseUnsupportedData when code is
+	// empty.
+	type step struct {
+		data string
+		code string
+	}
+	tests := []struct {
+		name   string
+		config *Config
+		steps  []step
+	}{
+		{
+			name:   "error reply",
+			config: &Config{},
+			steps:  []step{{garbage, common.CodeBadRequest}, {garbage, common.CodeBadRequest}},
+		},
+		{
+			name:   "closed after consecutive failures",
+			config: &Config{MaxMalformedMessages: 2},
+			steps: []step{
+				{garbage, common.CodeBadRequest},
+				{valid, common.CodeUnknownEvent},
+				{garbage, common.CodeBadRequest},
+				{garbage, ""},
+			},
+		},
+		{
+			name:   "limit disabled",
+			config: &Config{MaxMalformedMessages: -1},
+			steps: []step{
+				{garbage, common.CodeBadRequest},
+				{garbage, common.CodeBadRequest},
+				{garbage, common.CodeBadRequest},
+			},
+		},
+		{
+			name: "rate limited",
+			config: &Config{RateLimit: &RateLimit{
+				Connection: Limit{Rate: 0.001, Burst: 2},
+				Action:     RateLimitError,
+			}},
+			steps: []step{
+				{garbage, common.CodeBadRequest},
+				{valid, common.CodeUnknownEvent},
+				{garbage, common.CodeRateLimited},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, handler, url := newTestServer(t, tt.config)
+			ws := dialTestServer(t, url)
+			<-handler.opened
+
+			for i, step := range tt.steps {
+				if err := ws.WriteMessage(websocket.TextMessage, []byte(step.data)); err != nil {
+					t.Fatal(err)
+				}
+				if step.code == "" {
+					ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+					if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseUnsupportedData) {
+						t.Fatalf("step %d: read = %v, want unsupported data close", i, err)
+					}
+					continue
+				}
+				if msg := readMessage(t, ws); msg.Error == nil || msg.Error.Code != step.code {
+					t.Fatalf("step %d: got %+v, want a %s error", i, msg.Error, step.code)
+				}
+			}
+		})
+	}
+}
+
+func TestMalformedMessageMetrics(t *testing.T) {
+	metrics := &receivedMetrics{}
+	_, handler, url := newTestServer(t, &Config{Metrics: metrics})
+	ws := dialTestServer(t, url)
+	<-handler.opened
+
+	ws.WriteMessage(websocket.TextMessage, []byte("{"))
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"eventName":"missing"}`))
+	readMessage(t, ws)
+	readMessage(t, ws)
+
+	metrics.Lock()
+	defer metrics.Unlock()
+	if len(metrics.events) != 2 || metrics.events[0] != "malformed" || metrics.events[1] != "unknown" {
+		t.Errorf("received %q, want malformed then unknown", metrics.events)
+	}
+}
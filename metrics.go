@@ -0,0 +1,126 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"time"
+
+	"github.com/syleron/sockets/common"
+)
+
+// Reasons reported to Metrics.ConnectionRejected.
+const (
+	RejectOrigin   = "origin"
+	RejectShutdown = "shutdown"
+	RejectUpgrade  = "upgrade"
+	RejectAuth     = "unauthorized"
+)
+
+// Reasons reported to Metrics.MessageDropped.
+const (
+	DropQueueFull    = "queue_full"
+	DropOldest       = "dropped_oldest"
+	DropSlowConsumer = "slow_consumer"
+	DropClosed       = "closed"
+	DropEncodeError  = "encode_error"
+	DropWriteError   = "write_error"
+	// Cluster messages not sent to a peer of a TCPMeshAdapter
+	DropPeerQueueFull   = "peer_queue_full"
+	DropPeerUnreachable = "peer_unreachable"
+)
+
+// Metrics receives instrumentation events from the server. Implementations
+// must be safe for concurrent use, PrometheusMetrics is provided.
+type Metrics interface {
+	// A connection was upgraded, resumed connections are not counted again.
+	ConnectionOpened()
+	// A connection was closed for good.
+	ConnectionClosed()
+	// An upgrade was refused for the given reason.
+	ConnectionRejected(reason string)
+	// The number of sessions changed.
+	SessionsChanged(count int)
+	// The number of rooms with at least one member changed.
+	RoomsChanged(count int)
+	// A message was read from a client. Events without a handler are
+	// reported as "unknown" so clients can't create arbitrary labels, and
+	// messages that couldn't be decoded as "malformed".
+	MessageReceived(event string, bytes int)
+	// A message was written to a client.
+	MessageSent(event string, bytes int)
+	// An outbound message was discarded for the given reason.
+	MessageDropped(event, reason string)
+	// An event handler, including its middleware, finished.
+	EventHandled(event string, duration time.Duration)
+	// A broadcast was queued for the given number of local connections.
+	Broadcast(event string, recipients int)
+}
+
+// noopMetrics is used when no Metrics are configured.
+type noopMetrics struct{}
+
+func (noopMetrics) ConnectionOpened()                  {}
+func (noopMetrics) ConnectionClosed()                  {}
+func (noopMetrics) ConnectionRejected(string)          {}
+func (noopMetrics) SessionsChanged(int)                {}
+func (noopMetrics) RoomsChanged(int)                   {}
+func (noopMetrics) MessageReceived(string, int)        {}
+func (noopMetrics) MessageSent(string, int)            {}
+func (noopMetrics) MessageDropped(string, string)      {}
+func (noopMetrics) EventHandled(string, time.Duration) {}
+func (noopMetrics) Broadcast(string, int)              {}
+
+// metrics returns the metrics of the connection's server.
+func (c *Connection) metrics() Metrics {
+	if c.config == nil || c.config.Metrics == nil {
+		return noopMetrics{}
+	}
+	return c.config.Metrics
+}
+
+// dropReason maps an Emit error to the reason reported to Metrics.
+func dropReason(err error) string {
+	switch err {
+	case ErrSlowConsumer:
+		return DropSlowConsumer
+	case ErrConnectionClosed:
+		return DropClosed
+	default:
+		return DropQueueFull
+	}
+}
+
+// eventName returns the event of an outbound message.
+func eventName(msg interface{}) string {
+	switch m := msg.(type) {
+	case common.Response:
+		return m.EventName
+	case *common.Response:
+		return m.EventName
+	case common.Message:
+		return m.EventName
+	case *common.Message:
+		return m.EventName
+	}
+	return ""
+}
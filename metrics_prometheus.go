@@ -0,0 +1,269 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBuckets are the handler latency histogram buckets, in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// PrometheusMetrics collects Metrics in memory and serves them in the
+// Prometheus text exposition format. Mount it on the HTTP server to scrape it.
+type PrometheusMetrics struct {
+	namespace string
+	buckets   []float64
+
+	connections        float64
+	connectionsTotal   float64
+	sessions           float64
+	rooms              float64
+	rejected           map[string]float64
+	received           map[string]float64
+	receivedBytes      map[string]float64
+	sent               map[string]float64
+	sentBytes          map[string]float64
+	dropped            map[[2]string]float64
+	broadcasts         map[string]float64
+	broadcastReceivers map[string]float64
+	handlers           map[string]*histogram
+	sync.Mutex
+}
+
+type histogram struct {
+	counts []float64
+	count  float64
+	sum    float64
+}
+
+// NewPrometheusMetrics returns metrics named with the given namespace,
+// "sockets" when empty.
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "sockets"
+	}
+	return &PrometheusMetrics{
+		namespace:          namespace,
+		buckets:            DefaultBuckets,
+		rejected:           make(map[string]float64),
+		received:           make(map[string]float64),
+		receivedBytes:      make(map[string]float64),
+		sent:               make(map[string]float64),
+		sentBytes:          make(map[string]float64),
+		dropped:            make(map[[2]string]float64),
+		broadcasts:         make(map[string]float64),
+		broadcastReceivers: make(map[string]float64),
+		handlers:           make(map[string]*histogram),
+	}
+}
+
+func (m *PrometheusMetrics) ConnectionOpened() {
+	m.Lock()
+	defer m.Unlock()
+	m.connections++
+	m.connectionsTotal++
+}
+
+func (m *PrometheusMetrics) ConnectionClosed() {
+	m.Lock()
+	defer m.Unlock()
+	m.connections--
+}
+
+func (m *PrometheusMetrics) ConnectionRejected(reason string) {
+	m.Lock()
+	defer m.Unlock()
+	m.rejected[reason]++
+}
+
+func (m *PrometheusMetrics) SessionsChanged(count int) {
+	m.Lock()
+	defer m.Unlock()
+	m.sessions = float64(count)
+}
+
+func (m *PrometheusMetrics) RoomsChanged(count int) {
+	m.Lock()
+	defer m.Unlock()
+	m.rooms = float64(count)
+}
+
+func (m *PrometheusMetrics) MessageReceived(event string, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.received[event]++
+	m.receivedBytes[event] += float64(bytes)
+}
+
+func (m *PrometheusMetrics) MessageSent(event string, bytes int) {
+	m.Lock()
+	defer m.Unlock()
+	m.sent[event]++
+	m.sentBytes[event] += float64(bytes)
+}
+
+func (m *PrometheusMetrics) MessageDropped(event, reason string) {
+	m.Lock()
+	defer m.Unlock()
+	m.dropped[[2]string{event, reason}]++
+}
+
+func (m *PrometheusMetrics) EventHandled(event string, duration time.Duration) {
+	m.Lock()
+	defer m.Unlock()
+	h, ok := m.handlers[event]
+	if !ok {
+		h = &histogram{counts: make([]float64, len(m.buckets))}
+		m.handlers[event] = h
+	}
+	seconds := duration.Seconds()
+	for i, bound := range m.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func (m *PrometheusMetrics) Broadcast(event string, recipients int) {
+	m.Lock()
+	defer m.Unlock()
+	m.broadcasts[event]++
+	m.broadcastReceivers[event] += float64(recipients)
+}
+
+// ServeHTTP writes the current metrics in the text exposition format.
+func (m *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	out := bufio.NewWriter(w)
+	m.write(out)
+	out.Flush()
+}
+
+func (m *PrometheusMetrics) write(w *bufio.Writer) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.header(w, "connections", "gauge", "Open websocket connections.")
+	m.sample(w, "connections", nil, m.connections)
+	m.header(w, "connections_total", "counter", "Websocket connections opened.")
+	m.sample(w, "connections_total", nil, m.connectionsTotal)
+	m.header(w, "connections_rejected_total", "counter", "Websocket upgrades refused, by reason.")
+	m.labelled(w, "connections_rejected_total", "reason", m.rejected)
+	m.header(w, "sessions", "gauge", "Sessions with at least one connection.")
+	m.sample(w, "sessions", nil, m.sessions)
+	m.header(w, "rooms", "gauge", "Rooms with at least one member.")
+	m.sample(w, "rooms", nil, m.rooms)
+
+	m.header(w, "messages_received_total", "counter", "Messages received from clients, by event.")
+	m.labelled(w, "messages_received_total", "event", m.received)
+	m.header(w, "received_bytes_total", "counter", "Bytes received from clients, by event.")
+	m.labelled(w, "received_bytes_total", "event", m.receivedBytes)
+	m.header(w, "messages_sent_total", "counter", "Messages written to clients, by event.")
+	m.labelled(w, "messages_sent_total", "event", m.sent)
+	m.header(w, "sent_bytes_total", "counter", "Bytes written to clients, by event.")
+	m.labelled(w, "sent_bytes_total", "event", m.sentBytes)
+
+	m.header(w, "messages_dropped_total", "counter", "Outbound messages discarded, by event and reason.")
+	keys := make([][2]string, 0, len(m.dropped))
+	for key := range m.dropped {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		m.sample(w, "messages_dropped_total", []string{"event", key[0], "reason", key[1]}, m.dropped[key])
+	}
+
+	m.header(w, "broadcasts_total", "counter", "Broadcasts sent from this node, by event.")
+	m.labelled(w, "broadcasts_total", "event", m.broadcasts)
+	m.header(w, "broadcast_recipients_total", "counter", "Connections reached by broadcasts, by event.")
+	m.labelled(w, "broadcast_recipients_total", "event", m.broadcastReceivers)
+
+	m.header(w, "handler_duration_seconds", "histogram", "Time spent in event handlers, by event.")
+	for _, event := range sortedKeys(m.handlers) {
+		h := m.handlers[event]
+		for i, bound := range m.buckets {
+			le := strconv.FormatFloat(bound, 'g', -1, 64)
+			m.sample(w, "handler_duration_seconds_bucket", []string{"event", event, "le", le}, h.counts[i])
+		}
+		m.sample(w, "handler_duration_seconds_bucket", []string{"event", event, "le", "+Inf"}, h.count)
+		m.sample(w, "handler_duration_seconds_sum", []string{"event", event}, h.sum)
+		m.sample(w, "handler_duration_seconds_count", []string{"event", event}, h.count)
+	}
+}
+
+func (m *PrometheusMetrics) header(w *bufio.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s_%s %s\n", m.namespace, name, help)
+	fmt.Fprintf(w, "# TYPE %s_%s %s\n", m.namespace, name, kind)
+}
+
+func (m *PrometheusMetrics) labelled(w *bufio.Writer, name, label string, values map[string]float64) {
+	for _, value := range sortedKeys(values) {
+		m.sample(w, name, []string{label, value}, values[value])
+	}
+}
+
+// sample writes a single sample, labels alternate between names and values.
+func (m *PrometheusMetrics) sample(w *bufio.Writer, name string, labels []string, value float64) {
+	w.WriteString(m.namespace + "_" + name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i := 0; i < len(labels); i += 2 {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labels[i], escapeLabel(labels[i+1]))
+		}
+		w.WriteByte('}')
+	}
+	fmt.Fprintf(w, " %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
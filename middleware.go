@@ -0,0 +1,165 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"errors"
+	"runtime/debug"
+	"strings"
+
+	"github.com/syleron/sockets/common"
+	"github.com/syleron/sockets/schema"
+)
+
+// Middleware wraps an EventFunc. It may run code before and after calling
+// next, or stop the chain by not calling it at all.
+type Middleware func(next EventFunc) EventFunc
+
+// chain wraps handler with middleware so that the first middleware is the
+// outermost one.
+func chain(handler EventFunc, middleware []Middleware) EventFunc {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Recover returns middleware that recovers from panics in event handlers so a
+// single bad message cannot take down the connection's read loop. The client
+// is sent a common.CodeInternal error. EventHandler already recovers around
+// the whole chain, use Recover to let outer middleware keep running.
+func Recover() Middleware {
+	return func(next EventFunc) EventFunc {
+		return func(msg *common.Message, ctx *Context) {
+			defer recoverPanic(msg, ctx)
+			next(msg, ctx)
+		}
+	}
+}
+
+// recoverPanic logs a panic of the handler of msg and tells the client its
+// message failed. It must be deferred.
+func recoverPanic(msg *common.Message, ctx *Context) {
+	if r := recover(); r != nil {
+		ctx.logger().Error("recovered from panic in event handler", ctx.logArgs("event", msg.EventName, "panic", r, "stack", string(debug.Stack()))...)
+		ctx.sendError(&common.Error{Code: common.CodeInternal, Message: "internal error"})
+	}
+}
+
+// RequireSession returns middleware that only lets connections with a session
+// through, like registering the event as protected. Other callers are sent a
+// common.CodeUnauthorized error.
+func RequireSession() Middleware {
+	return func(next EventFunc) EventFunc {
+		return func(msg *common.Message, ctx *Context) {
+			if !ctx.HasSession() {
+				ctx.logger().Warn("protected event called without a session, handler dropped", ctx.logArgs("event", msg.EventName)...)
+				ctx.sendError(&common.Error{Code: common.CodeUnauthorized, Message: "event requires a session"})
+				return
+			}
+			next(msg, ctx)
+		}
+	}
+}
+
+// RequireRoles returns middleware that only lets connections whose identity
+// has at least one of roles through. Other callers are sent a "forbidden"
+// error.
+func RequireRoles(roles ...string) Middleware {
+	return func(next EventFunc) EventFunc {
+		return func(msg *common.Message, ctx *Context) {
+			identity := ctx.Identity()
+			for _, role := range roles {
+				if identity.HasRole(role) {
+					next(msg, ctx)
+					return
+				}
+			}
+			forbid(msg, ctx, "requires one of the roles: "+strings.Join(roles, ", "))
+		}
+	}
+}
+
+// RequireScopes returns middleware that only lets connections whose identity
+// was granted every one of scopes through. Other callers are sent a
+// "forbidden" error.
+func RequireScopes(scopes ...string) Middleware {
+	return func(next EventFunc) EventFunc {
+		return func(msg *common.Message, ctx *Context) {
+			identity := ctx.Identity()
+			for _, scope := range scopes {
+				if !identity.HasScope(scope) {
+					forbid(msg, ctx, "requires the scopes: "+strings.Join(scopes, " "))
+					return
+				}
+			}
+			next(msg, ctx)
+		}
+	}
+}
+
+// Validate returns middleware that checks the payload of an event against
+// payloadSchema before calling the handler. Invalid payloads are answered
+// with an "invalid_payload" error whose details list the path and reason of
+// every problem found.
+func Validate(payloadSchema *schema.Schema) Middleware {
+	return func(next EventFunc) EventFunc {
+		return func(msg *common.Message, ctx *Context) {
+			if err := validatePayload(payloadSchema, msg, ctx); err != nil {
+				var problems schema.Errors
+				if !errors.As(err, &problems) {
+					ctx.ReplyError(&common.Error{Code: common.CodeBadRequest, Message: "malformed payload: " + err.Error()})
+					return
+				}
+				ctx.logger().Debug("invalid payload", ctx.logArgs("event", msg.EventName, "error", err)...)
+				ctx.ReplyError(&common.Error{
+					Code:    common.CodeInvalidPayload,
+					Message: "payload failed validation: " + problems[0].Error(),
+					Details: problems,
+				})
+				return
+			}
+			next(msg, ctx)
+		}
+	}
+}
+
+func validatePayload(payloadSchema *schema.Schema, msg *common.Message, ctx *Context) error {
+	if len(msg.Data) == 0 {
+		return payloadSchema.Validate(nil)
+	}
+	// JSON payloads can be validated as they are
+	if ctx.Codec() == common.JSON {
+		return payloadSchema.ValidateJSON(msg.Data)
+	}
+	var payload interface{}
+	if err := ctx.Decode(&payload); err != nil {
+		return err
+	}
+	return payloadSchema.Validate(payload)
+}
+
+func forbid(msg *common.Message, ctx *Context, reason string) {
+	ctx.logger().Warn("event forbidden", ctx.logArgs("event", msg.EventName, "reason", reason)...)
+	ctx.ReplyError(&common.Error{Code: common.CodeForbidden, Message: reason})
+}
@@ -0,0 +1,131 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// ErrOriginNotAllowed is returned by HandleConnection when the request's origin is rejected.
+var ErrOriginNotAllowed = errors.New("sockets: origin not allowed")
+
+// originPolicy decides which origins may open a websocket, protecting
+// against cross-site websocket hijacking.
+type originPolicy struct {
+	exact     map[string]bool
+	wildcards []wildcardOrigin
+	patterns  []*regexp.Regexp
+	check     func(r *http.Request) bool
+}
+
+// wildcardOrigin matches any subdomain of suffix. An empty scheme or port
+// matches any scheme or port.
+type wildcardOrigin struct {
+	scheme string
+	suffix string
+	port   string
+}
+
+func newOriginPolicy(c *Config) *originPolicy {
+	p := &originPolicy{
+		exact: make(map[string]bool),
+		check: c.CheckOrigin,
+	}
+
+	for _, pattern := range c.AllowedOriginPatterns {
+		// Patterns have to match the whole origin, "example\.com" must not
+		// accept "https://example.com.evil.net"
+		p.patterns = append(p.patterns, regexp.MustCompile(`^(?:`+pattern.String()+`)$`))
+	}
+
+	for _, origin := range c.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+
+		scheme, host := "", origin
+		if i := strings.Index(origin, "://"); i >= 0 {
+			scheme, host = origin[:i], origin[i+3:]
+		}
+		if strings.HasPrefix(host, "*.") {
+			w := wildcardOrigin{scheme: scheme, suffix: host[1:]}
+			if i := strings.LastIndex(w.suffix, ":"); i >= 0 {
+				w.suffix, w.port = w.suffix[:i], w.suffix[i+1:]
+			}
+			p.wildcards = append(p.wildcards, w)
+			continue
+		}
+		p.exact[origin] = true
+	}
+
+	return p
+}
+
+// unrestricted reports whether no origin rules were configured.
+func (p *originPolicy) unrestricted() bool {
+	return len(p.exact) == 0 && len(p.wildcards) == 0 && len(p.patterns) == 0 && p.check == nil
+}
+
+func (p *originPolicy) allowed(r *http.Request) bool {
+	if p.unrestricted() {
+		return true
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		// Browsers always send an origin, only non-browser clients omit it
+		return true
+	}
+
+	if p.matches(strings.ToLower(origin)) {
+		return true
+	}
+
+	return p.check != nil && p.check(r)
+}
+
+func (p *originPolicy) matches(origin string) bool {
+	if p.exact[origin] {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err == nil && u.Host != "" {
+		for _, w := range p.wildcards {
+			if (w.scheme == "" || w.scheme == u.Scheme) && (w.port == "" || w.port == u.Port()) &&
+				strings.HasSuffix(u.Hostname(), w.suffix) {
+				return true
+			}
+		}
+	}
+
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(origin) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,132 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestOriginPolicy(t *testing.T) {
+	config := &Config{
+		AllowedOrigins: []string{
+			"https://example.com/",
+			"https://*.example.org",
+			"*.example.net",
+			"https://*.example.io:8443",
+		},
+		AllowedOriginPatterns: []*regexp.Regexp{
+			regexp.MustCompile(`^http://localhost:\d+$`),
+			regexp.MustCompile(`https://example\.dev`),
+		},
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("X-Trusted") == "yes"
+		},
+	}
+
+	tests := []struct {
+		origin  string
+		trusted bool
+		allowed bool
+	}{
+		{"", false, true},
+		{"https://example.com", false, true},
+		{"HTTPS://EXAMPLE.COM", false, true},
+		{"http://example.com", false, false},
+		{"https://sub.example.com", false, false},
+		{"https://app.example.org", false, true},
+		{"https://a.b.example.org", false, true},
+		{"http://app.example.org", false, false},
+		{"https://app.example.org:8443", false, true},
+		{"https://example.org", false, false},
+		{"https://evilexample.org", false, false},
+		{"http://app.example.net", false, true},
+		{"wss://app.example.net", false, true},
+		{"http://localhost:3000", false, true},
+		{"http://localhost:3000.evil.com", false, false},
+		{"https://example.com:8443", false, false},
+		{"https://app.example.io:8443", false, true},
+		{"https://app.example.io", false, false},
+		{"https://app.example.io:9443", false, false},
+		{"https://example.dev", false, true},
+		{"https://example.dev.evil.net", false, false},
+		{"https://evil.net/https://example.dev", false, false},
+		{"https://evil.com", false, false},
+		{"https://evil.com", true, true},
+	}
+
+	policy := newOriginPolicy(config)
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		if tt.origin != "" {
+			r.Header.Set("Origin", tt.origin)
+		}
+		if tt.trusted {
+			r.Header.Set("X-Trusted", "yes")
+		}
+		if got := policy.allowed(r); got != tt.allowed {
+			t.Errorf("allowed(%q, trusted %v) = %v, want %v", tt.origin, tt.trusted, got, tt.allowed)
+		}
+	}
+}
+
+func TestOriginPolicyUnrestricted(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Origin", "https://anywhere.com")
+	if !newOriginPolicy(&Config{}).allowed(r) {
+		t.Error("origin rejected without any rules")
+	}
+}
+
+func TestOriginRejected(t *testing.T) {
+	rejected := make(chan string, 1)
+	_, _, url := newTestServer(t, &Config{
+		AllowedOrigins: []string{"https://example.com"},
+		OnOriginRejected: func(r *http.Request, origin string) {
+			rejected <- origin
+		},
+	})
+
+	header := http.Header{"Origin": {"https://evil.com"}}
+	_, resp, err := websocket.DefaultDialer.Dial(url, header)
+	if err == nil {
+		t.Fatal("upgrade from a foreign origin accepted")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("response = %v, want %d", resp, http.StatusForbidden)
+	}
+	if origin := <-rejected; origin != "https://evil.com" {
+		t.Errorf("OnOriginRejected got %q", origin)
+	}
+
+	header.Set("Origin", "https://example.com")
+	ws, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("upgrade from an allowed origin: %v", err)
+	}
+	ws.Close()
+}
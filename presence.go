@@ -0,0 +1,485 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Presence events emitted to the members of a room. With an Adapter the
+// presence of users connected to other nodes is shared, a user joins a room
+// once for the whole cluster and leaves it when their last connection on any
+// node does.
+const (
+	PresenceJoinEvent   = "presence:join"
+	PresenceLeaveEvent  = "presence:leave"
+	PresenceUpdateEvent = "presence:update"
+)
+
+// Events of ClusterPresence messages that are not about a room.
+const (
+	// The user's session connections on the publishing node.
+	presenceSessionEvent = "presence:session"
+	// Asks the other nodes to publish their presence, sent by new nodes.
+	presenceSyncEvent = "presence:sync"
+)
+
+// Presence describes a user in a room. Every connection of the user's
+// session counts as a single presence.
+type Presence struct {
+	Username    string                 `json:"username"`
+	Status      map[string]interface{} `json:"status,omitempty"`
+	Connections int                    `json:"connections"`
+}
+
+// PresenceEvent is the data of the presence events.
+type PresenceEvent struct {
+	Room     string                 `json:"room"`
+	Username string                 `json:"username"`
+	Status   map[string]interface{} `json:"status,omitempty"`
+}
+
+// presenceEntry is a user in a room. connections holds the user's
+// connections on this node, nodes the number of connections on other nodes.
+type presenceEntry struct {
+	connections map[string]bool
+	nodes       map[string]int
+	status      map[string]interface{}
+}
+
+func newPresenceEntry() *presenceEntry {
+	return &presenceEntry{
+		connections: make(map[string]bool),
+		nodes:       make(map[string]int),
+	}
+}
+
+func (e *presenceEntry) present() bool {
+	return len(e.connections) > 0 || len(e.nodes) > 0
+}
+
+func (e *presenceEntry) count() int {
+	count := len(e.connections)
+	for _, connections := range e.nodes {
+		count += connections
+	}
+	return count
+}
+
+// presenceTracker knows which users are in which rooms. It is guarded by
+// the Sockets lock, events and cluster updates are queued and sent by
+// flushPresence once the lock is released.
+type presenceTracker struct {
+	rooms map[string]map[string]*presenceEntry
+	// Session connections of users on other nodes, by node
+	online map[string]map[string]int
+	// Nodes we have heard from
+	peers    map[string]bool
+	pending  []presenceNotice
+	outgoing []presenceUpdate
+	// Keeps the flushed events and updates in the order they were queued
+	flushing sync.Mutex
+}
+
+type presenceNotice struct {
+	event string
+	data  PresenceEvent
+}
+
+// presenceUpdate is a ClusterPresence message waiting to be published.
+type presenceUpdate struct {
+	event    string
+	room     string
+	username string
+	state    presenceState
+}
+
+// presenceState is the data of ClusterPresence messages. It holds the
+// user's connections on the publishing node, not a difference, so
+// receiving an update twice or after a newer one can't skew the count.
+type presenceState struct {
+	Connections int                    `json:"connections"`
+	Status      map[string]interface{} `json:"status,omitempty"`
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{
+		rooms:  make(map[string]map[string]*presenceEntry),
+		online: make(map[string]map[string]int),
+		peers:  make(map[string]bool),
+	}
+}
+
+func connectionUsername(conn *Connection) string {
+	if conn.Session == nil {
+		return ""
+	}
+	return conn.Username
+}
+
+// presenceJoin records that conn is in room. The caller must hold the write lock.
+func (s *Sockets) presenceJoin(room string, conn *Connection) {
+	username := connectionUsername(conn)
+	if s.presence == nil || username == "" {
+		return
+	}
+	// Connections of a deleted session no longer count
+	if session, ok := s.Sessions[username]; !ok || session.connections[conn.UUID] == nil {
+		return
+	}
+
+	users, ok := s.presence.rooms[room]
+	if !ok {
+		users = make(map[string]*presenceEntry)
+		s.presence.rooms[room] = users
+	}
+	entry, ok := users[username]
+	if !ok {
+		entry = newPresenceEntry()
+		users[username] = entry
+	}
+	if entry.connections[conn.UUID] {
+		return
+	}
+	if !entry.present() {
+		s.presence.pending = append(s.presence.pending, presenceNotice{
+			event: PresenceJoinEvent,
+			data:  PresenceEvent{Room: room, Username: username, Status: copyStatus(entry.status)},
+		})
+	}
+	entry.connections[conn.UUID] = true
+	s.announcePresence(PresenceJoinEvent, room, username, entry)
+}
+
+// presenceLeave records that conn left room. The caller must hold the write lock.
+func (s *Sockets) presenceLeave(room string, conn *Connection) {
+	username := connectionUsername(conn)
+	if s.presence == nil || username == "" {
+		return
+	}
+
+	users := s.presence.rooms[room]
+	entry, ok := users[username]
+	if !ok || !entry.connections[conn.UUID] {
+		return
+	}
+	delete(entry.connections, conn.UUID)
+	s.announcePresence(PresenceLeaveEvent, room, username, entry)
+	if entry.present() {
+		return
+	}
+
+	delete(users, username)
+	if len(users) == 0 {
+		delete(s.presence.rooms, room)
+	}
+	s.presence.pending = append(s.presence.pending, presenceNotice{
+		event: PresenceLeaveEvent,
+		data:  PresenceEvent{Room: room, Username: username},
+	})
+}
+
+// presenceLeaveAll records that conn left every room it is in, without
+// leaving the rooms themselves. The caller must hold the write lock.
+func (s *Sockets) presenceLeaveAll(conn *Connection) {
+	for _, room := range conn.Rooms() {
+		s.presenceLeave(room, conn)
+	}
+}
+
+// announcePresence queues a ClusterPresence update with the user's
+// connections to room on this node. The caller must hold the write lock.
+func (s *Sockets) announcePresence(event, room, username string, entry *presenceEntry) {
+	if s.config.Adapter == nil {
+		return
+	}
+	s.presence.outgoing = append(s.presence.outgoing, presenceUpdate{
+		event:    event,
+		room:     room,
+		username: username,
+		state:    presenceState{Connections: len(entry.connections), Status: copyStatus(entry.status)},
+	})
+}
+
+// announceSession queues a ClusterPresence update with the connections of the
+// user's session on this node. The caller must hold the write lock.
+func (s *Sockets) announceSession(username string) {
+	if s.presence == nil || s.config.Adapter == nil {
+		return
+	}
+	connections := 0
+	if session, ok := s.Sessions[username]; ok {
+		connections = len(session.connections)
+	}
+	s.presence.outgoing = append(s.presence.outgoing, presenceUpdate{
+		event:    presenceSessionEvent,
+		username: username,
+		state:    presenceState{Connections: connections},
+	})
+}
+
+// announceAll queues the whole presence of this node for a node that just
+// joined the cluster. The caller must hold the write lock.
+func (s *Sockets) announceAll() {
+	for username := range s.Sessions {
+		s.announceSession(username)
+	}
+	for room, users := range s.presence.rooms {
+		for username, entry := range users {
+			if len(entry.connections) > 0 {
+				s.announcePresence(PresenceJoinEvent, room, username, entry)
+			}
+		}
+	}
+}
+
+// handleClusterPresence applies the presence published by another node.
+func (s *Sockets) handleClusterPresence(msg *ClusterMessage) {
+	if s.presence == nil {
+		return
+	}
+
+	var state presenceState
+	if msg.Event != presenceSyncEvent {
+		if err := json.Unmarshal(msg.Data, &state); err != nil {
+			s.config.Logger.Warn("ignoring invalid presence update", "node", msg.Node, "error", err)
+			return
+		}
+	}
+
+	s.Lock()
+	// Tell nodes we haven't heard from before who is here
+	if !s.presence.peers[msg.Node] || msg.Event == presenceSyncEvent {
+		s.presence.peers[msg.Node] = true
+		s.announceAll()
+	}
+	switch msg.Event {
+	case presenceSyncEvent:
+	case presenceSessionEvent:
+		s.applySessionPresence(msg.Node, msg.Username, state)
+	default:
+		s.applyRoomPresence(msg.Node, msg.Event, msg.Room, msg.Username, state)
+	}
+	s.Unlock()
+
+	// Flushing publishes, which adapters may deliver to other nodes before
+	// returning. Doing it from here could wait on a flush that is delivering
+	// the message we are handling.
+	go s.flushPresence()
+}
+
+// applySessionPresence records the session connections of a user on another
+// node. The caller must hold the write lock.
+func (s *Sockets) applySessionPresence(node, username string, state presenceState) {
+	online, ok := s.presence.online[node]
+	if !ok {
+		online = make(map[string]int)
+		s.presence.online[node] = online
+	}
+	if state.Connections > 0 {
+		online[username] = state.Connections
+		return
+	}
+	delete(online, username)
+	if len(online) == 0 {
+		delete(s.presence.online, node)
+	}
+}
+
+// applyRoomPresence records the connections of a user to a room on another
+// node and queues the events for the room's members on this node. The caller
+// must hold the write lock.
+func (s *Sockets) applyRoomPresence(node, event, room, username string, state presenceState) {
+	users, ok := s.presence.rooms[room]
+	if !ok {
+		users = make(map[string]*presenceEntry)
+		s.presence.rooms[room] = users
+	}
+	entry, ok := users[username]
+	if !ok {
+		entry = newPresenceEntry()
+		users[username] = entry
+	}
+
+	present := entry.present()
+	if state.Connections > 0 {
+		entry.nodes[node] = state.Connections
+	} else {
+		delete(entry.nodes, node)
+	}
+
+	switch {
+	case !entry.present():
+		delete(users, username)
+		if len(users) == 0 {
+			delete(s.presence.rooms, room)
+		}
+		if present {
+			s.presence.pending = append(s.presence.pending, presenceNotice{
+				event: PresenceLeaveEvent,
+				data:  PresenceEvent{Room: room, Username: username},
+			})
+		}
+	case !present:
+		entry.status = copyStatus(state.Status)
+		s.presence.pending = append(s.presence.pending, presenceNotice{
+			event: PresenceJoinEvent,
+			data:  PresenceEvent{Room: room, Username: username, Status: copyStatus(state.Status)},
+		})
+	case event == PresenceUpdateEvent:
+		entry.status = copyStatus(state.Status)
+		s.presence.pending = append(s.presence.pending, presenceNotice{
+			event: PresenceUpdateEvent,
+			data:  PresenceEvent{Room: room, Username: username, Status: copyStatus(state.Status)},
+		})
+	}
+}
+
+// flushPresence sends the queued presence events to the members of their
+// rooms on this node and publishes the queued updates to the cluster. It
+// must be called without holding the lock.
+func (s *Sockets) flushPresence() {
+	if s.presence == nil {
+		return
+	}
+
+	s.presence.flushing.Lock()
+	defer s.presence.flushing.Unlock()
+
+	s.Lock()
+	pending, outgoing := s.presence.pending, s.presence.outgoing
+	s.presence.pending, s.presence.outgoing = nil, nil
+	s.Unlock()
+
+	for _, notice := range pending {
+		s.broadcastToRoomLocal(notice.data.Room, "", notice.event, notice.data)
+	}
+	for _, update := range outgoing {
+		s.publish(&ClusterMessage{
+			Type:     ClusterPresence,
+			Event:    update.event,
+			Room:     update.room,
+			Username: update.username,
+		}, update.state)
+	}
+}
+
+// PresenceInRoom returns the users present in room on any node.
+func (s *Sockets) PresenceInRoom(room string) []Presence {
+	s.RLock()
+	defer s.RUnlock()
+
+	presence := []Presence{}
+	if s.presence == nil {
+		return presence
+	}
+	for username, entry := range s.presence.rooms[room] {
+		presence = append(presence, Presence{
+			Username:    username,
+			Status:      copyStatus(entry.status),
+			Connections: entry.count(),
+		})
+	}
+	sort.Slice(presence, func(i, j int) bool {
+		return presence[i].Username < presence[j].Username
+	})
+	return presence
+}
+
+// UserRooms returns the rooms the user is present in on any node.
+func (s *Sockets) UserRooms(username string) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	rooms := []string{}
+	if s.presence == nil {
+		return rooms
+	}
+	for room, users := range s.presence.rooms {
+		if _, ok := users[username]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// IsOnline reports whether the user has a session with at least one
+// connection. With Presence enabled sessions on other nodes count too.
+func (s *Sockets) IsOnline(username string) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	if session, ok := s.Sessions[username]; ok && len(session.connections) > 0 {
+		return true
+	}
+	if s.presence == nil {
+		return false
+	}
+	for _, online := range s.presence.online {
+		if online[username] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetPresenceStatus replaces the status metadata of a user in room, for
+// example {"away": true} or {"typing": true}, and notifies the room.
+func (s *Sockets) SetPresenceStatus(room, username string, status map[string]interface{}) error {
+	defer s.flushPresence()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if s.presence == nil {
+		return errors.New("presence tracking is disabled")
+	}
+	entry, ok := s.presence.rooms[room][username]
+	if !ok {
+		return fmt.Errorf("user %s is not present in room %s", username, room)
+	}
+
+	entry.status = copyStatus(status)
+	s.presence.pending = append(s.presence.pending, presenceNotice{
+		event: PresenceUpdateEvent,
+		data:  PresenceEvent{Room: room, Username: username, Status: copyStatus(status)},
+	})
+	s.announcePresence(PresenceUpdateEvent, room, username, entry)
+	return nil
+}
+
+func copyStatus(status map[string]interface{}) map[string]interface{} {
+	if status == nil {
+		return nil
+	}
+	c := make(map[string]interface{}, len(status))
+	for k, v := range status {
+		c[k] = v
+	}
+	return c
+}
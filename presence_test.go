@@ -0,0 +1,264 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+// recordingAdapter records the messages published to the cluster.
+type recordingAdapter struct {
+	messages []*ClusterMessage
+	sync.Mutex
+}
+
+func (a *recordingAdapter) Publish(msg *ClusterMessage) error {
+	a.Lock()
+	defer a.Unlock()
+	a.messages = append(a.messages, msg)
+	return nil
+}
+
+// lastPresence returns the connections of the last presence update published
+// for the user in room, or for the user's session when room is empty.
+func (a *recordingAdapter) lastPresence(t *testing.T, room, username string) int {
+	t.Helper()
+	a.Lock()
+	defer a.Unlock()
+	for i := len(a.messages) - 1; i >= 0; i-- {
+		msg := a.messages[i]
+		if msg.Type != ClusterPresence || msg.Room != room || msg.Username != username {
+			continue
+		}
+		var state presenceState
+		if err := json.Unmarshal(msg.Data, &state); err != nil {
+			t.Fatal(err)
+		}
+		return state.Connections
+	}
+	t.Fatalf("no presence of %s in %q was published", username, room)
+	return 0
+}
+
+func (a *recordingAdapter) Subscribe(func(msg *ClusterMessage)) {}
+
+func (a *recordingAdapter) Close() error { return nil }
+
+// openSession connects a client, gives it a session for username and joins
+// it to room.
+func openSession(t *testing.T, s *Sockets, handler *testHandler, url, username, room string) (*websocket.Conn, *Connection) {
+	t.Helper()
+	ws := dialTestServer(t, url)
+	conn := (<-handler.opened).Connection
+	if err := s.AddSession(username, conn); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.JoinRoom(room, conn.UUID); err != nil {
+		t.Fatal(err)
+	}
+	return ws, conn
+}
+
+// readPresence reads the next presence event received by ws.
+func readPresence(t *testing.T, ws *websocket.Conn) (string, PresenceEvent) {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg common.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	var data PresenceEvent
+	if err := json.Unmarshal(msg.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	return msg.EventName, data
+}
+
+// waitUntil polls cond until it holds, presence from other nodes is applied
+// asynchronously.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func presenceUsernames(s *Sockets, room string) []string {
+	usernames := []string{}
+	for _, presence := range s.PresenceInRoom(room) {
+		usernames = append(usernames, presence.Username)
+	}
+	return usernames
+}
+
+func TestPresenceSessionRemoved(t *testing.T) {
+	tests := []struct {
+		name   string
+		remove func(s *Sockets, conn *Connection) error
+		// Whether the connection is detached from its session
+		detached bool
+	}{
+		{"DeleteSession", func(s *Sockets, conn *Connection) error {
+			return s.DeleteSession("alice")
+		}, false},
+		{"ClearSession", func(s *Sockets, conn *Connection) error {
+			conn.ClearSession()
+			return nil
+		}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			adapter := &recordingAdapter{}
+			s, handler, url := newTestServer(t, &Config{Presence: true, Adapter: adapter})
+			bob, _ := openSession(t, s, handler, url, "bob", "team")
+			_, alice := openSession(t, s, handler, url, "alice", "team")
+
+			// Members are told about their own join too
+			readPresence(t, bob)
+			if event, data := readPresence(t, bob); event != PresenceJoinEvent || data.Username != "alice" {
+				t.Fatalf("got %s %+v, want alice joining", event, data)
+			}
+			if err := tt.remove(s, alice); err != nil {
+				t.Fatal(err)
+			}
+			if event, data := readPresence(t, bob); event != PresenceLeaveEvent || data.Username != "alice" {
+				t.Fatalf("got %s %+v, want alice leaving", event, data)
+			}
+
+			if got := presenceUsernames(s, "team"); !reflect.DeepEqual(got, []string{"bob"}) {
+				t.Errorf("PresenceInRoom = %v, want [bob]", got)
+			}
+			if got := s.UserRooms("alice"); len(got) != 0 {
+				t.Errorf("UserRooms(alice) = %v, want none", got)
+			}
+			if s.IsOnline("alice") {
+				t.Error("alice is still online")
+			}
+			if tt.detached && alice.HasSession() {
+				t.Error("alice still has a session")
+			}
+
+			// Rejoining without a session does not bring the user back
+			s.LeaveRoom("team", alice.UUID)
+			s.JoinRoom("team", alice.UUID)
+			if got := presenceUsernames(s, "team"); !reflect.DeepEqual(got, []string{"bob"}) {
+				t.Errorf("PresenceInRoom after rejoining = %v, want [bob]", got)
+			}
+
+			// The other nodes are told alice is gone
+			if n := adapter.lastPresence(t, "team", "alice"); n != 0 {
+				t.Errorf("published %d connections of alice in team, want 0", n)
+			}
+			if n := adapter.lastPresence(t, "", "alice"); n != 0 {
+				t.Errorf("published %d session connections of alice, want 0", n)
+			}
+			if n := adapter.lastPresence(t, "team", "bob"); n != 1 {
+				t.Errorf("published %d connections of bob in team, want 1", n)
+			}
+		})
+	}
+}
+
+func TestPresenceCluster(t *testing.T) {
+	bus := NewMemoryBus()
+	node := func() (*Sockets, *testHandler, string) {
+		return newTestServer(t, &Config{Presence: true, Adapter: bus.Adapter()})
+	}
+	s1, handler1, url1 := node()
+	s2, handler2, url2 := node()
+
+	bob, _ := openSession(t, s2, handler2, url2, "bob", "team")
+	readPresence(t, bob)
+
+	// Alice joining on the other node reaches bob
+	alice1, _ := openSession(t, s1, handler1, url1, "alice", "team")
+	if event, data := readPresence(t, bob); event != PresenceJoinEvent || data.Username != "alice" {
+		t.Fatalf("got %s %+v, want alice joining", event, data)
+	}
+	if got := presenceUsernames(s2, "team"); !reflect.DeepEqual(got, []string{"alice", "bob"}) {
+		t.Errorf("PresenceInRoom = %v, want [alice bob]", got)
+	}
+	if got := s2.UserRooms("alice"); !reflect.DeepEqual(got, []string{"team"}) {
+		t.Errorf("UserRooms(alice) = %v, want [team]", got)
+	}
+	if !s2.IsOnline("alice") {
+		t.Error("alice is not online on the other node")
+	}
+
+	// A second connection of alice on bob's node is not a new join, neither
+	// bob nor alice are told about it
+	alice2, alice2Conn := openSession(t, s2, handler2, url2, "alice", "team")
+	if err := s1.SetPresenceStatus("team", "alice", map[string]interface{}{"away": true}); err != nil {
+		t.Fatal(err)
+	}
+	if event, data := readPresence(t, bob); event != PresenceUpdateEvent || data.Username != "alice" || data.Status["away"] != true {
+		t.Fatalf("got %s %+v, want alice away", event, data)
+	}
+	for _, presence := range s2.PresenceInRoom("team") {
+		if presence.Username == "alice" && presence.Connections != 2 {
+			t.Errorf("alice has %d connections, want 2", presence.Connections)
+		}
+	}
+
+	// A node started later learns who is already present
+	s3, _, _ := node()
+	waitUntil(t, "the new node to sync", func() bool {
+		return reflect.DeepEqual(presenceUsernames(s3, "team"), []string{"alice", "bob"})
+	})
+
+	// Alice stays present while she has a connection anywhere
+	alice1.Close()
+	waitUntil(t, "alice's first connection to leave", func() bool {
+		for _, presence := range s2.PresenceInRoom("team") {
+			if presence.Username == "alice" {
+				return presence.Connections == 1
+			}
+		}
+		return false
+	})
+	s2.LeaveRoom("team", alice2Conn.UUID)
+	if event, data := readPresence(t, bob); event != PresenceLeaveEvent || data.Username != "alice" {
+		t.Fatalf("got %s %+v, want alice leaving", event, data)
+	}
+
+	alice2.Close()
+	waitUntil(t, "alice to go offline", func() bool {
+		return !s1.IsOnline("alice") && !s3.IsOnline("alice")
+	})
+	waitUntil(t, "alice to leave team everywhere", func() bool {
+		return reflect.DeepEqual(presenceUsernames(s1, "team"), []string{"bob"}) &&
+			reflect.DeepEqual(presenceUsernames(s3, "team"), []string{"bob"})
+	})
+}
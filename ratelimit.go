@@ -0,0 +1,212 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+// Limit describes a token bucket refilled at Rate events per second holding
+// at most Burst tokens. A zero Rate means unlimited.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// RateLimitAction is what happens to an event that exceeds a limit.
+type RateLimitAction int
+
+const (
+	// RateLimitDrop silently drops the event.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitError drops the event and replies with a "rate_limited" error.
+	RateLimitError
+	// RateLimitClose closes the connection with a policy violation close code.
+	RateLimitClose
+)
+
+// RateLimitScope identifies which limit an event exceeded.
+type RateLimitScope string
+
+const (
+	RateLimitScopeConnection RateLimitScope = "connection"
+	RateLimitScopeEvent      RateLimitScope = "event"
+	RateLimitScopeUser       RateLimitScope = "user"
+)
+
+type RateLimit struct {
+	// Limit on all events sent by a single connection.
+	Connection Limit
+	// Limits on individual events, per connection.
+	Events map[string]Limit
+	// Limit on all events sent by a session username across its connections.
+	User Limit
+	// What to do with events over the limit.
+	Action RateLimitAction
+	// Called whenever an event is rate limited.
+	OnViolation func(ctx *Context, event string, scope RateLimitScope)
+}
+
+// tokenBucket implements a single Limit.
+type tokenBucket struct {
+	limit  Limit
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(limit Limit) *tokenBucket {
+	if limit.Burst <= 0 {
+		limit.Burst = int(math.Max(1, math.Ceil(limit.Rate)))
+	}
+	return &tokenBucket{
+		limit:  limit,
+		tokens: float64(limit.Burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	return b.allowAt(time.Now())
+}
+
+// allowAt takes a token if one is available at now.
+func (b *tokenBucket) allowAt(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// connectionLimiter holds the buckets of a single connection.
+type connectionLimiter struct {
+	connection *tokenBucket
+	events     map[string]*tokenBucket
+	sync.Mutex
+}
+
+func newConnectionLimiter(config *RateLimit) *connectionLimiter {
+	l := &connectionLimiter{
+		events: make(map[string]*tokenBucket),
+	}
+	if config.Connection.Rate > 0 {
+		l.connection = newTokenBucket(config.Connection)
+	}
+	return l
+}
+
+func (l *connectionLimiter) event(config *RateLimit, event string) *tokenBucket {
+	limit, ok := config.Events[event]
+	if !ok || limit.Rate <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	bucket, ok := l.events[event]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		l.events[event] = bucket
+	}
+	return bucket
+}
+
+// userLimiter holds one bucket per session username.
+type userLimiter struct {
+	buckets map[string]*tokenBucket
+	sync.Mutex
+}
+
+func newUserLimiter() *userLimiter {
+	return &userLimiter{
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+func (l *userLimiter) bucket(limit Limit, username string) *tokenBucket {
+	l.Lock()
+	defer l.Unlock()
+	bucket, ok := l.buckets[username]
+	if !ok {
+		bucket = newTokenBucket(limit)
+		l.buckets[username] = bucket
+	}
+	return bucket
+}
+
+func (l *userLimiter) remove(username string) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.buckets, username)
+}
+
+// allowEvent applies the configured rate limits to msg. It returns false and
+// carries out the configured action when a limit is exceeded.
+func (s *Sockets) allowEvent(msg *common.Message, ctx *Context) bool {
+	config := s.config.RateLimit
+	if config == nil {
+		return true
+	}
+
+	scope := RateLimitScope("")
+	limiter := ctx.limiter
+	switch {
+	case limiter.connection != nil && !limiter.connection.allow():
+		scope = RateLimitScopeConnection
+	case !allowBucket(limiter.event(config, msg.EventName)):
+		scope = RateLimitScopeEvent
+	case config.User.Rate > 0 && ctx.Session != nil && ctx.Username != "" &&
+		!s.userLimits.bucket(config.User, ctx.Username).allow():
+		scope = RateLimitScopeUser
+	default:
+		return true
+	}
+
+	if config.OnViolation != nil {
+		config.OnViolation(ctx, msg.EventName, scope)
+	}
+
+	switch config.Action {
+	case RateLimitError:
+		ctx.sendError(&common.Error{Code: common.CodeRateLimited, Message: "rate limit exceeded"})
+	case RateLimitClose:
+		ctx.closeWithCode(websocket.ClosePolicyViolation, "rate limit exceeded")
+	}
+	return false
+}
+
+func allowBucket(b *tokenBucket) bool {
+	return b == nil || b.allow()
+}
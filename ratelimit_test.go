@@ -0,0 +1,131 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+func TestTokenBucket(t *testing.T) {
+	type take struct {
+		after time.Duration
+		want  bool
+	}
+	tests := []struct {
+		name  string
+		limit Limit
+		takes []take
+	}{
+		{
+			name:  "burst then refill",
+			limit: Limit{Rate: 10, Burst: 2},
+			takes: []take{{0, true}, {0, true}, {0, false}, {50 * time.Millisecond, false}, {50 * time.Millisecond, true}, {0, false}},
+		},
+		{
+			name:  "burst defaults to rate",
+			limit: Limit{Rate: 3},
+			takes: []take{{0, true}, {0, true}, {0, true}, {0, false}},
+		},
+		{
+			name:  "fractional rate holds one token",
+			limit: Limit{Rate: 0.5},
+			takes: []take{{0, true}, {time.Second, false}, {time.Second, true}},
+		},
+		{
+			name:  "refill is capped at burst",
+			limit: Limit{Rate: 100, Burst: 2},
+			takes: []take{{time.Hour, true}, {0, true}, {0, false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bucket := newTokenBucket(tt.limit)
+			now := bucket.last
+			for i, take := range tt.takes {
+				now = now.Add(take.after)
+				if got := bucket.allowAt(now); got != take.want {
+					t.Fatalf("take %d = %v, want %v", i, got, take.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitActions(t *testing.T) {
+	tests := []struct {
+		action RateLimitAction
+		check  func(t *testing.T, ws *websocket.Conn)
+	}{
+		{RateLimitError, func(t *testing.T, ws *websocket.Conn) {
+			var msg common.Message
+			if err := ws.ReadJSON(&msg); err != nil {
+				t.Fatal(err)
+			}
+			if msg.EventName != common.ErrorEvent || msg.Error == nil || msg.Error.Code != common.CodeRateLimited {
+				t.Errorf("got %+v, want a rate limited error", msg)
+			}
+		}},
+		{RateLimitClose, func(t *testing.T, ws *websocket.Conn) {
+			_, _, err := ws.ReadMessage()
+			if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+				t.Errorf("read = %v, want policy violation close", err)
+			}
+		}},
+	}
+
+	for _, tt := range tests {
+		violations := make(chan RateLimitScope, 1)
+		s, handler, url := newTestServer(t, &Config{RateLimit: &RateLimit{
+			Events: map[string]Limit{"chat": {Rate: 0.001, Burst: 1}},
+			Action: tt.action,
+			OnViolation: func(ctx *Context, event string, scope RateLimitScope) {
+				violations <- scope
+			},
+		}})
+		handled := make(chan struct{}, 2)
+		s.HandleEvent("chat", func(msg *common.Message, ctx *Context) {
+			handled <- struct{}{}
+		}, false)
+
+		ws := dialTestServer(t, url)
+		<-handler.opened
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for i := 0; i < 2; i++ {
+			ws.WriteJSON(common.Message{EventName: "chat", Data: json.RawMessage(`null`)})
+		}
+		tt.check(t, ws)
+
+		if scope := <-violations; scope != RateLimitScopeEvent {
+			t.Errorf("violation scope = %s, want %s", scope, RateLimitScopeEvent)
+		}
+		if len(handled) != 1 {
+			t.Errorf("handled %d events, want 1", len(handled))
+		}
+	}
+}
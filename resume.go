@@ -0,0 +1,292 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+type ResumeConfig struct {
+	// How long a dropped connection waits for its client to resume it before
+	// it is closed for good.
+	GracePeriod time.Duration
+	// Number of recent outbound messages kept per connection for replay.
+	BufferSize int
+}
+
+// replayBuffer numbers the messages emitted to a connection and keeps the
+// most recent ones so they can be replayed after a reconnect.
+type replayBuffer struct {
+	size  int
+	seq   uint64
+	items []sequenced
+	sync.Mutex
+}
+
+type sequenced struct {
+	seq uint64
+	msg outbound
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{size: size}
+}
+
+// record assigns the next sequence number to msg and remembers it. Messages
+// that can't carry a sequence number are passed through untouched.
+func (b *replayBuffer) record(msg outbound) outbound {
+	b.Lock()
+	defer b.Unlock()
+
+	stamped, ok := withSeq(msg.msg, b.seq+1)
+	if !ok {
+		return msg
+	}
+	b.seq++
+	msg.msg = stamped
+
+	b.items = append(b.items, sequenced{seq: b.seq, msg: msg})
+	if len(b.items) > b.size {
+		b.items = append(b.items[:0], b.items[len(b.items)-b.size:]...)
+	}
+	return msg
+}
+
+// since returns the messages sent after seq, the last sequence number issued
+// and whether every missed message was still buffered.
+func (b *replayBuffer) since(seq uint64) ([]outbound, uint64, bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	var missed []outbound
+	for _, item := range b.items {
+		if item.seq > seq {
+			missed = append(missed, item.msg)
+		}
+	}
+	complete := seq >= b.seq || (len(b.items) > 0 && b.items[0].seq <= seq+1)
+	return missed, b.seq, complete
+}
+
+// withSeq returns a copy of msg carrying seq, for the message types the
+// library sends.
+func withSeq(msg interface{}, seq uint64) (interface{}, bool) {
+	switch m := msg.(type) {
+	case common.Response:
+		m.Seq = seq
+		return m, true
+	case *common.Response:
+		copied := *m
+		copied.Seq = seq
+		return &copied, true
+	case common.Message:
+		m.Seq = seq
+		return m, true
+	case *common.Message:
+		copied := *m
+		copied.Seq = seq
+		return &copied, true
+	}
+	return nil, false
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("sockets: failed to generate resume token: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// enableResume prepares a new connection for session resumption. The resume
+// token is queued before the connection is registered so it is always the
+// first message the client receives.
+func (s *Sockets) enableResume(conn *Connection) {
+	conn.replay = newReplayBuffer(s.config.Resume.BufferSize)
+	conn.resumeToken = newResumeToken()
+	conn.send = make(chan outbound, s.config.SendQueueSize)
+	conn.push(resumeInfo(conn, 0, false, true))
+}
+
+// resumeInfo builds the unsequenced event telling the client how to resume.
+func resumeInfo(conn *Connection, seq uint64, resumed, complete bool) outbound {
+	return outbound{msg: common.Response{
+		EventName: common.ResumeEvent,
+		Data: common.ResumeInfo{
+			Token:    conn.resumeToken,
+			Seq:      seq,
+			Resumed:  resumed,
+			Complete: complete,
+		},
+	}}
+}
+
+// parkable reports whether a connection whose read failed with err should
+// wait for its client to resume it instead of being closed.
+func (s *Sockets) parkable(conn *Connection, err error) bool {
+	if conn.replay == nil || atomic.LoadInt32(&conn.closedByServer) == 1 {
+		return false
+	}
+	// The client said goodbye, it won't be back
+	if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+		return false
+	}
+	s.RLock()
+	defer s.RUnlock()
+	return !s.closing
+}
+
+// park stops the connection's websocket but keeps the connection in its
+// session and rooms for the grace period. Messages emitted to it meanwhile
+// are buffered for replay.
+func (s *Sockets) park(conn *Connection) {
+	atomic.StoreInt32(&conn.parked, 1)
+	s.stopExpiry(conn)
+	conn.closeOnce.Do(func() {
+		close(conn.done)
+	})
+	conn.Conn.Close()
+
+	s.Lock()
+	defer s.Unlock()
+	token := conn.resumeToken
+	s.parked[token] = conn
+	conn.parkTimer = time.AfterFunc(s.config.Resume.GracePeriod, func() {
+		s.expireParked(token)
+	})
+}
+
+// expireParked closes a parked connection whose grace period ran out.
+func (s *Sockets) expireParked(token string) {
+	s.Lock()
+	conn, ok := s.parked[token]
+	delete(s.parked, token)
+	s.Unlock()
+
+	if ok {
+		s.closeWS(conn)
+	}
+}
+
+// expireAllParked closes every parked connection, used when shutting down.
+func (s *Sockets) expireAllParked() {
+	s.Lock()
+	parked := s.parked
+	s.parked = make(map[string]*Connection)
+	s.Unlock()
+
+	for _, conn := range parked {
+		conn.parkTimer.Stop()
+		s.closeWS(conn)
+	}
+}
+
+// takeParked returns the parked connection matching the resume token of the
+// request along with the last sequence number the client has seen. When the
+// request was authenticated the parked connection must belong to the same user.
+func (s *Sockets) takeParked(r *http.Request, identity *Identity) (*Connection, uint64) {
+	query := r.URL.Query()
+	token := query.Get("resume")
+	if token == "" {
+		return nil, 0
+	}
+	seq, _ := strconv.ParseUint(query.Get("seq"), 10, 64)
+
+	s.Lock()
+	defer s.Unlock()
+	conn, ok := s.parked[token]
+	if !ok || (identity != nil && connectionUsername(conn) != identity.Username) {
+		return nil, 0
+	}
+	if !conn.parkTimer.Stop() {
+		// Unknown token or the grace period already ran out
+		return nil, 0
+	}
+	delete(s.parked, token)
+	return conn, seq
+}
+
+// resumeConnection hands the identity, session, rooms and replay buffer of a
+// parked connection to conn, then sends the client what it missed.
+func (s *Sockets) resumeConnection(parked, conn *Connection, seq uint64) {
+	conn.UUID = parked.UUID
+	if conn.identity == nil {
+		// A client resuming without credentials of its own keeps its identity,
+		// including one given with SetIdentity
+		conn.identity = parked.Identity()
+	}
+	conn.Session = parked.Session
+	conn.Data = parked.Data
+	conn.rooms = parked.rooms
+	conn.replay = parked.replay
+	conn.resumeToken = newResumeToken()
+	conn.config = s.config
+	conn.send = make(chan outbound, s.config.SendQueueSize)
+
+	s.Lock()
+	s.Connections[conn.UUID] = conn
+	for _, membership := range conn.Memberships() {
+		room, ok := s.rooms[membership.Name]
+		if !ok {
+			continue
+		}
+		if membership.Channel == "" {
+			room.members[conn.UUID] = conn
+		} else if channel, ok := room.channels[membership.Channel]; ok {
+			channel[conn.UUID] = conn
+		}
+	}
+	if session, ok := s.Sessions[connectionUsername(conn)]; ok && session == conn.Session {
+		session.addConnection(conn)
+	}
+	missed, last, complete := conn.replay.since(seq)
+	s.Unlock()
+
+	// Nothing else writes to the websocket until the write pump starts, so
+	// the replay can't interleave with newer messages. A failed write shows
+	// up as a read error, which parks the connection again.
+	for _, msg := range append([]outbound{resumeInfo(conn, last, true, complete)}, missed...) {
+		if err := conn.write(msg); err != nil {
+			s.config.Logger.Warn("failed to replay messages", conn.logArgs("error", err)...)
+			break
+		}
+	}
+	conn.startWritePump(s.config)
+
+	// Shutdown may have started while this connection was upgrading
+	s.RLock()
+	closing := s.closing
+	s.RUnlock()
+	if closing {
+		conn.closeWithCode(websocket.CloseGoingAway, "server shutting down")
+	}
+}
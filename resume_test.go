@@ -0,0 +1,192 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+func TestReplayBufferSince(t *testing.T) {
+	tests := []struct {
+		name     string
+		recorded int
+		seq      uint64
+		missed   []uint64
+		complete bool
+	}{
+		{"nothing recorded", 0, 0, nil, true},
+		{"up to date", 3, 3, nil, true},
+		{"missed some", 3, 1, []uint64{2, 3}, true},
+		{"missed everything buffered", 5, 2, []uint64{3, 4, 5}, true},
+		{"missed more than buffered", 5, 1, []uint64{3, 4, 5}, false},
+		{"ahead of the server", 2, 7, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buffer := newReplayBuffer(3)
+			for i := 0; i < tt.recorded; i++ {
+				buffer.record(outbound{msg: common.Response{EventName: "chat"}})
+			}
+			// Messages without a sequence number are not buffered
+			buffer.record(outbound{msg: "raw"})
+
+			missed, last, complete := buffer.since(tt.seq)
+			var seqs []uint64
+			for _, msg := range missed {
+				seqs = append(seqs, msg.msg.(common.Response).Seq)
+			}
+			if !reflect.DeepEqual(seqs, tt.missed) {
+				t.Errorf("missed %v, want %v", seqs, tt.missed)
+			}
+			if last != uint64(tt.recorded) {
+				t.Errorf("last = %d, want %d", last, tt.recorded)
+			}
+			if complete != tt.complete {
+				t.Errorf("complete = %v, want %v", complete, tt.complete)
+			}
+		})
+	}
+}
+
+// readMessage reads the next message received by ws.
+func readMessage(t *testing.T, ws *websocket.Conn) common.Message {
+	t.Helper()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg common.Message
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func readResumeInfo(t *testing.T, ws *websocket.Conn) common.ResumeInfo {
+	t.Helper()
+	msg := readMessage(t, ws)
+	if msg.EventName != common.ResumeEvent {
+		t.Fatalf("got %s, want %s", msg.EventName, common.ResumeEvent)
+	}
+	var info common.ResumeInfo
+	if err := json.Unmarshal(msg.Data, &info); err != nil {
+		t.Fatal(err)
+	}
+	return info
+}
+
+func TestResume(t *testing.T) {
+	s, handler, url := newTestServer(t, &Config{Resume: &ResumeConfig{GracePeriod: time.Minute}})
+	ws := dialTestServer(t, url)
+	conn := (<-handler.opened).Connection
+	info := readResumeInfo(t, ws)
+	if info.Resumed || info.Token == "" {
+		t.Fatalf("got %+v for a new connection", info)
+	}
+	token := info.Token
+
+	conn.Emit(common.Response{EventName: "chat", Data: 1})
+	if msg := readMessage(t, ws); msg.Seq != 1 {
+		t.Fatalf("first message has seq %d", msg.Seq)
+	}
+
+	// Drop the connection without a close frame, then emit while it is parked
+	ws.UnderlyingConn().Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.RLock()
+		_, parked := s.parked[token]
+		s.RUnlock()
+		if parked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection was not parked")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	conn.Emit(common.Response{EventName: "chat", Data: 2})
+	conn.Emit(common.Response{EventName: "chat", Data: 3})
+
+	resumed := dialTestServer(t, url+"?resume="+token+"&seq=1")
+	info = readResumeInfo(t, resumed)
+	if !info.Resumed || !info.Complete || info.Seq != 3 {
+		t.Fatalf("got %+v, want a complete resume at seq 3", info)
+	}
+	for _, seq := range []uint64{2, 3} {
+		if msg := readMessage(t, resumed); msg.EventName != "chat" || msg.Seq != seq {
+			t.Fatalf("got %s with seq %d, want chat with seq %d", msg.EventName, msg.Seq, seq)
+		}
+	}
+	select {
+	case ctx := <-handler.opened:
+		t.Fatalf("resuming opened connection %s", ctx.UUID)
+	default:
+	}
+
+	// A token can only be used once
+	again := dialTestServer(t, url+"?resume="+token+"&seq=3")
+	if info := readResumeInfo(t, again); info.Resumed {
+		t.Fatal("resumed a connection twice")
+	}
+}
+
+func TestResumeKeepsIdentity(t *testing.T) {
+	s, handler, url := newTestServer(t, &Config{Resume: &ResumeConfig{GracePeriod: time.Minute}})
+	ws := dialTestServer(t, url)
+	conn := (<-handler.opened).Connection
+	token := readResumeInfo(t, ws).Token
+	identity := &Identity{Username: "alice", Roles: []string{"admin"}, ExpiresAt: time.Now().Add(time.Hour)}
+	if err := s.SetIdentity(conn.UUID, identity); err != nil {
+		t.Fatal(err)
+	}
+
+	ws.UnderlyingConn().Close()
+	waitUntil(t, "the connection to be parked", func() bool {
+		s.RLock()
+		defer s.RUnlock()
+		_, parked := s.parked[token]
+		return parked
+	})
+
+	resumed := dialTestServer(t, url+"?resume="+token+"&seq=0")
+	if info := readResumeInfo(t, resumed); !info.Resumed {
+		t.Fatalf("got %+v, want a resume", info)
+	}
+	s.RLock()
+	conn = s.Connections[conn.UUID]
+	s.RUnlock()
+	if !conn.Identity().HasRole("admin") {
+		t.Errorf("resumed connection has identity %+v, want alice with the admin role", conn.Identity())
+	}
+	conn.RLock()
+	scheduled := conn.expiryTimer != nil
+	conn.RUnlock()
+	if !scheduled {
+		t.Error("expiry of the resumed identity is not scheduled")
+	}
+}
@@ -0,0 +1,402 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Room describes a single membership, Channel is empty for the room itself.
+type Room struct {
+	Name    string `json:"name"`
+	Channel string `json:"channel"`
+}
+
+// roomIndex holds the members of a room and of each channel within it so
+// room broadcasts don't have to scan every connection.
+type roomIndex struct {
+	members  map[string]*Connection
+	channels map[string]map[string]*Connection
+}
+
+func newRoomIndex() *roomIndex {
+	return &roomIndex{
+		members:  make(map[string]*Connection),
+		channels: make(map[string]map[string]*Connection),
+	}
+}
+
+// InRoom reports whether the connection is a member of room.
+func (c *Connection) InRoom(room string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	_, ok := c.rooms[room]
+	return ok
+}
+
+// InRoomChannel reports whether the connection joined channel within room.
+func (c *Connection) InRoomChannel(room, channel string) bool {
+	c.RLock()
+	defer c.RUnlock()
+	return c.rooms[room][channel]
+}
+
+// Rooms returns the names of the rooms the connection is a member of.
+func (c *Connection) Rooms() []string {
+	c.RLock()
+	defer c.RUnlock()
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Memberships returns every room and room channel the connection has joined.
+func (c *Connection) Memberships() []Room {
+	c.RLock()
+	defer c.RUnlock()
+	var memberships []Room
+	for room, channels := range c.rooms {
+		memberships = append(memberships, Room{Name: room})
+		for channel := range channels {
+			memberships = append(memberships, Room{Name: room, Channel: channel})
+		}
+	}
+	sort.Slice(memberships, func(i, j int) bool {
+		if memberships[i].Name != memberships[j].Name {
+			return memberships[i].Name < memberships[j].Name
+		}
+		return memberships[i].Channel < memberships[j].Channel
+	})
+	return memberships
+}
+
+// The index helpers below keep s.rooms in step with the connection's own
+// memberships. The caller must hold the write lock.
+
+func (s *Sockets) indexJoinRoom(room string, conn *Connection) {
+	index, ok := s.rooms[room]
+	if !ok {
+		index = newRoomIndex()
+		s.rooms[room] = index
+		s.config.Metrics.RoomsChanged(len(s.rooms))
+	}
+	index.members[conn.UUID] = conn
+}
+
+func (s *Sockets) indexLeaveRoom(room string, conn *Connection) {
+	index, ok := s.rooms[room]
+	if !ok {
+		return
+	}
+	delete(index.members, conn.UUID)
+	for channel, members := range index.channels {
+		delete(members, conn.UUID)
+		if len(members) == 0 {
+			delete(index.channels, channel)
+		}
+	}
+	if len(index.members) == 0 {
+		delete(s.rooms, room)
+		s.config.Metrics.RoomsChanged(len(s.rooms))
+	}
+}
+
+func (s *Sockets) indexJoinRoomChannel(room, channel string, conn *Connection) {
+	index, ok := s.rooms[room]
+	if !ok {
+		return
+	}
+	members, ok := index.channels[channel]
+	if !ok {
+		members = make(map[string]*Connection)
+		index.channels[channel] = members
+	}
+	members[conn.UUID] = conn
+}
+
+func (s *Sockets) indexLeaveRoomChannel(room, channel string, conn *Connection) {
+	index, ok := s.rooms[room]
+	if !ok {
+		return
+	}
+	if members, ok := index.channels[channel]; ok {
+		delete(members, conn.UUID)
+		if len(members) == 0 {
+			delete(index.channels, channel)
+		}
+	}
+}
+
+// leaveAllRooms removes the connection from every room it is a member of.
+func (s *Sockets) leaveAllRooms(conn *Connection) {
+	for _, room := range conn.Rooms() {
+		conn.leaveRoom(room)
+		s.indexLeaveRoom(room, conn)
+		s.presenceLeave(room, conn)
+	}
+}
+
+func (c *Connection) joinRoom(room string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.rooms[room]; ok {
+		return false
+	}
+	c.rooms[room] = make(map[string]bool)
+	return true
+}
+
+func (c *Connection) leaveRoom(room string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.rooms[room]; !ok {
+		return false
+	}
+	delete(c.rooms, room)
+	return true
+}
+
+func (c *Connection) joinRoomChannel(room, channel string) bool {
+	c.Lock()
+	defer c.Unlock()
+	channels, ok := c.rooms[room]
+	if !ok {
+		return false
+	}
+	channels[channel] = true
+	return true
+}
+
+func (c *Connection) leaveRoomChannel(room, channel string) bool {
+	c.Lock()
+	defer c.Unlock()
+	if !c.rooms[room][channel] {
+		return false
+	}
+	delete(c.rooms[room], channel)
+	return true
+}
+
+// Rooms returns the rooms the connection with the given UUID is a member of.
+func (s *Sockets) Rooms(uuid string) ([]string, error) {
+	if uuid == "" {
+		return nil, errors.New("invalid input: UUID is empty")
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if conn, ok := s.Connections[uuid]; ok {
+		return conn.Rooms(), nil
+	}
+
+	return nil, fmt.Errorf("unable to find client connection for UUID %s", uuid)
+}
+
+// GetUserRoom returns the first room, in alphabetical order, of the connection
+// with the given UUID that belongs to username.
+//
+// Deprecated: connections can be in several rooms, use Rooms.
+func (s *Sockets) GetUserRoom(username, uuid string) (string, error) {
+	if username == "" || uuid == "" {
+		return "", errors.New("invalid input: username or UUID is empty")
+	}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if session, ok := s.Sessions[username]; ok {
+		if conn, ok := session.connections[uuid]; ok {
+			if rooms := conn.Rooms(); len(rooms) > 0 {
+				return rooms[0], nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("unable to find room for user %s with UUID %s", username, uuid)
+}
+
+// JoinRoom adds the connection to room. Memberships of other rooms are kept.
+func (s *Sockets) JoinRoom(room, uuid string) error {
+	if room == "" || uuid == "" {
+		return errors.New("invalid input: room or UUID is empty")
+	}
+
+	defer s.flushPresence()
+
+	s.Lock()
+	defer s.Unlock()
+
+	if conn, ok := s.Connections[uuid]; ok {
+		if conn.joinRoom(room) {
+			s.indexJoinRoom(room, conn)
+			s.presenceJoin(room, conn)
+		}
+		s.config.Logger.Debug("joined room", conn.logArgs("room", room)...)
+		return nil
+	}
+
+	return fmt.Errorf("unable to find client connection for UUID %s", uuid)
+}
+
+// LeaveRoom removes the connection from room and every channel within it.
+func (s *Sockets) LeaveRoom(room, uuid string) error {
+	if room == "" || uuid == "" {
+		return errors.New("invalid input: room or UUID is empty")
+	}
+
+	defer s.flushPresence()
+
+	s.Lock()
+	defer s.Unlock()
+
+	conn, ok := s.Connections[uuid]
+	if !ok {
+		return fmt.Errorf("unable to find client connection for UUID %s", uuid)
+	}
+	if !conn.leaveRoom(room) {
+		return fmt.Errorf("connection with UUID %s is not in room %s", uuid, room)
+	}
+	s.indexLeaveRoom(room, conn)
+	s.presenceLeave(room, conn)
+
+	s.config.Logger.Debug("left room", conn.logArgs("room", room)...)
+	return nil
+}
+
+// JoinRoomChannel adds the connection to channel within room. The connection
+// must already be a member of room.
+func (s *Sockets) JoinRoomChannel(room, channel, uuid string) error {
+	if room == "" || channel == "" || uuid == "" {
+		return errors.New("invalid input: room, channel or UUID is empty")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	conn, ok := s.Connections[uuid]
+	if !ok {
+		return fmt.Errorf("unable to find client connection for UUID %s", uuid)
+	}
+	if !conn.joinRoomChannel(room, channel) {
+		return fmt.Errorf("connection with UUID %s is not in room %s", uuid, room)
+	}
+	s.indexJoinRoomChannel(room, channel, conn)
+
+	s.config.Logger.Debug("joined room channel", conn.logArgs("room", room, "channel", channel)...)
+	return nil
+}
+
+// LeaveRoomChannel removes the connection from channel within room while
+// keeping its membership of the room itself.
+func (s *Sockets) LeaveRoomChannel(room, channel, uuid string) error {
+	if room == "" || channel == "" || uuid == "" {
+		return errors.New("invalid input: room, channel or UUID is empty")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	conn, ok := s.Connections[uuid]
+	if !ok {
+		return fmt.Errorf("unable to find client connection for UUID %s", uuid)
+	}
+	if !conn.leaveRoomChannel(room, channel) {
+		return fmt.Errorf("connection with UUID %s is not in channel %s of room %s", uuid, channel, room)
+	}
+	s.indexLeaveRoomChannel(room, channel, conn)
+
+	s.config.Logger.Debug("left room channel", conn.logArgs("room", room, "channel", channel)...)
+	return nil
+}
+
+// RoomMembers returns the UUIDs of the connections in room.
+func (s *Sockets) RoomMembers(room string) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	if index, ok := s.rooms[room]; ok {
+		return sortedUUIDs(index.members)
+	}
+	return []string{}
+}
+
+// RoomCount returns the number of connections in room.
+func (s *Sockets) RoomCount(room string) int {
+	s.RLock()
+	defer s.RUnlock()
+
+	if index, ok := s.rooms[room]; ok {
+		return len(index.members)
+	}
+	return 0
+}
+
+// RoomChannelMembers returns the UUIDs of the connections in channel within room.
+func (s *Sockets) RoomChannelMembers(room, channel string) []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	if index, ok := s.rooms[room]; ok {
+		return sortedUUIDs(index.channels[channel])
+	}
+	return []string{}
+}
+
+// RoomChannelCount returns the number of connections in channel within room.
+func (s *Sockets) RoomChannelCount(room, channel string) int {
+	s.RLock()
+	defer s.RUnlock()
+
+	if index, ok := s.rooms[room]; ok {
+		return len(index.channels[channel])
+	}
+	return 0
+}
+
+// RoomNames returns the names of all rooms that currently have members.
+func (s *Sockets) RoomNames() []string {
+	s.RLock()
+	defer s.RUnlock()
+
+	rooms := make([]string, 0, len(s.rooms))
+	for room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+func sortedUUIDs(connections map[string]*Connection) []string {
+	uuids := make([]string, 0, len(connections))
+	for uuid := range connections {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	return uuids
+}
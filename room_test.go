@@ -0,0 +1,69 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoomMemberships(t *testing.T) {
+	s, handler, url := newTestServer(t, &Config{})
+	dialTestServer(t, url)
+	ctx := <-handler.opened
+	uuid := ctx.Connection.UUID
+	if err := s.AddSession("alice", ctx.Connection); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, room := range []string{"team", "alice", "doc"} {
+		if err := s.JoinRoom(room, uuid); err != nil {
+			t.Fatalf("JoinRoom(%s): %v", room, err)
+		}
+	}
+	if err := s.LeaveRoom("doc", uuid); err != nil {
+		t.Fatal(err)
+	}
+
+	rooms, err := s.Rooms(uuid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"alice", "team"}; !reflect.DeepEqual(rooms, want) {
+		t.Errorf("Rooms = %v, want %v", rooms, want)
+	}
+	if got := s.RoomMembers("team"); !reflect.DeepEqual(got, []string{uuid}) {
+		t.Errorf("RoomMembers(team) = %v", got)
+	}
+	if got := s.RoomCount("doc"); got != 0 {
+		t.Errorf("RoomCount(doc) = %d, want 0", got)
+	}
+
+	room, err := s.GetUserRoom("alice", uuid)
+	if err != nil || room != "alice" {
+		t.Errorf("GetUserRoom = %q, %v, want alice", room, err)
+	}
+	if _, err := s.GetUserRoom("bob", uuid); err == nil {
+		t.Error("GetUserRoom found a room for another user")
+	}
+}
@@ -0,0 +1,888 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+// Package schema validates decoded message payloads against a subset of JSON
+// Schema draft 2020-12.
+//
+// Supported keywords are type, enum, const, properties, patternProperties,
+// additionalProperties, required, minProperties, maxProperties, items,
+// prefixItems, minItems, maxItems, uniqueItems, minLength, maxLength,
+// pattern, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf,
+// allOf, anyOf, oneOf, not, $defs and local $ref ("#/$defs/name"). Other
+// keywords, format included, are treated as annotations and ignored.
+//
+// Numbers are compared exactly. Documents holding numbers with more than 512
+// digits or an exponent beyond ±512 are rejected, as are values that take
+// more than 262144 steps to validate. Schemas whose $ref lead back to
+// themselves without moving into the value don't compile.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxDepth bounds how deeply schemas may nest through $ref while validating.
+const maxDepth = 128
+
+// maxSteps bounds the schema nodes a single validation may visit, so that
+// nested anyOf, oneOf and not can't take exponential time.
+const maxSteps = 1 << 18
+
+// Numbers are compared exactly, which gets expensive for huge literals such
+// as 9e999999. Documents with longer mantissas or exponents are rejected.
+const (
+	maxNumberDigits   = 512
+	maxNumberExponent = 512
+)
+
+// Schema is a compiled JSON Schema, safe for concurrent use.
+type Schema struct {
+	root *node
+}
+
+// ValidationError describes why the value at Path, a JSON Pointer, is invalid.
+type ValidationError struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+func (e ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Reason
+	}
+	return e.Path + ": " + e.Reason
+}
+
+// Errors is returned by Validate when the value doesn't match the schema.
+type Errors []ValidationError
+
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+type node struct {
+	// Boolean schemas, true accepts and false rejects everything
+	always *bool
+
+	types    []string
+	enum     []interface{}
+	hasConst bool
+	constVal interface{}
+
+	properties           map[string]*node
+	patternProperties    []patternNode
+	additionalProperties *node
+	required             []string
+	minProperties        *int
+	maxProperties        *int
+
+	items       *node
+	prefixItems []*node
+	minItems    *int
+	maxItems    *int
+	uniqueItems bool
+
+	minLength *int
+	maxLength *int
+	pattern   *regexp.Regexp
+
+	minimum          *big.Rat
+	maximum          *big.Rat
+	exclusiveMinimum *big.Rat
+	exclusiveMaximum *big.Rat
+	multipleOf       *big.Rat
+
+	allOf []*node
+	anyOf []*node
+	oneOf []*node
+	not   *node
+
+	ref      string
+	resolved *node
+}
+
+type patternNode struct {
+	pattern *regexp.Regexp
+	schema  *node
+}
+
+// Compile parses a JSON Schema document.
+func Compile(data []byte) (*Schema, error) {
+	doc, err := decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schema: %w", err)
+	}
+	c := &compiler{nodes: make(map[string]*node)}
+	root, err := c.compile(doc, "")
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range c.refs {
+		target, ok := c.nodes[strings.TrimPrefix(n.ref, "#")]
+		if !ok {
+			return nil, fmt.Errorf("invalid schema: unresolved $ref %q", n.ref)
+		}
+		n.resolved = target
+	}
+	if err := c.checkCycles(); err != nil {
+		return nil, err
+	}
+	return &Schema{root: root}, nil
+}
+
+// MustCompile is like Compile but panics when the schema is invalid, for
+// schemas defined at init time.
+func MustCompile(data string) *Schema {
+	s, err := Compile([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// ValidateJSON validates a JSON document. It returns Errors when the document
+// doesn't match the schema.
+func (s *Schema) ValidateJSON(data []byte) error {
+	v, err := decode(data)
+	if err != nil {
+		return Errors{{Reason: "invalid JSON: " + err.Error()}}
+	}
+	return s.validate(v)
+}
+
+// Validate validates any value that encodes to JSON, such as a value decoded
+// by a codec. It returns Errors when the value doesn't match the schema.
+func (s *Schema) Validate(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode value: %w", err)
+	}
+	return s.ValidateJSON(data)
+}
+
+func (s *Schema) validate(v interface{}) error {
+	st := &validation{steps: new(int)}
+	s.root.validate(v, "", 0, st)
+	if *st.steps > maxSteps {
+		return Errors{{Reason: "validation is too expensive"}}
+	}
+	if len(st.errs) > 0 {
+		return st.errs
+	}
+	return nil
+}
+
+// validation is the state of a single validation.
+type validation struct {
+	errs Errors
+	// Stop at the first error, when only whether the value matches counts
+	first bool
+	// Schema nodes visited, shared with the checks of anyOf, oneOf and not
+	steps *int
+}
+
+func (st *validation) fail(path, reason string) {
+	st.errs = append(st.errs, ValidationError{Path: path, Reason: reason})
+}
+
+// done reports whether the remaining keywords can be skipped.
+func (st *validation) done() bool {
+	return *st.steps > maxSteps || (st.first && len(st.errs) > 0)
+}
+
+// decode parses JSON keeping numbers exact.
+func decode(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err := decoder.Decode(&v); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+	if err := checkNumbers(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// checkNumbers rejects the numbers of a decoded document that are too long
+// to compare exactly.
+func checkNumbers(v interface{}) error {
+	switch v := v.(type) {
+	case json.Number:
+		if !boundedNumber(v.String()) {
+			literal := v.String()
+			if len(literal) > 20 {
+				literal = literal[:20] + "..."
+			}
+			return fmt.Errorf("number %s is too large", literal)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			if err := checkNumbers(item); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			if err := checkNumbers(item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// boundedNumber reports whether the JSON number literal s has at most
+// maxNumberDigits digits and an exponent of at most maxNumberExponent.
+func boundedNumber(s string) bool {
+	mantissa, exponent := s, ""
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		mantissa, exponent = s[:i], s[i+1:]
+	}
+	digits := len(strings.TrimPrefix(mantissa, "-"))
+	if strings.Contains(mantissa, ".") {
+		digits--
+	}
+	if digits > maxNumberDigits {
+		return false
+	}
+	if exponent == "" {
+		return true
+	}
+	exponent = strings.TrimLeft(strings.TrimLeft(exponent, "+-"), "0")
+	if len(exponent) > 4 {
+		return false
+	}
+	e, err := strconv.Atoi("0" + exponent)
+	return err == nil && e <= maxNumberExponent
+}
+
+type compiler struct {
+	nodes map[string]*node
+	refs  []*node
+}
+
+// checkCycles rejects schemas that lead back to themselves through $ref,
+// allOf, anyOf, oneOf or not without moving into the value, validating them
+// would never end.
+func (c *compiler) checkCycles() error {
+	ptrs := make([]string, 0, len(c.nodes))
+	names := make(map[*node]string, len(c.nodes))
+	for ptr, n := range c.nodes {
+		ptrs = append(ptrs, ptr)
+		names[n] = ptr
+	}
+	sort.Strings(ptrs)
+
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[*node]int)
+	var visit func(n *node) error
+	visit = func(n *node) error {
+		switch state[n] {
+		case visiting:
+			return fmt.Errorf("invalid schema at %q: $ref cycle that never moves into the value", names[n])
+		case visited:
+			return nil
+		}
+		state[n] = visiting
+		next := append(append(append([]*node{}, n.allOf...), n.anyOf...), n.oneOf...)
+		for _, sub := range append(next, n.not, n.resolved) {
+			if sub == nil {
+				continue
+			}
+			if err := visit(sub); err != nil {
+				return err
+			}
+		}
+		state[n] = visited
+		return nil
+	}
+	for _, ptr := range ptrs {
+		if err := visit(c.nodes[ptr]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *compiler) compile(raw interface{}, ptr string) (*node, error) {
+	n := &node{}
+	c.nodes[ptr] = n
+
+	if always, ok := raw.(bool); ok {
+		n.always = &always
+		return n, nil
+	}
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid schema at %q: must be an object or a boolean", ptr)
+	}
+
+	var err error
+	fail := func(keyword string, reason string) error {
+		return fmt.Errorf("invalid schema at %q: %s %s", ptr+"/"+keyword, keyword, reason)
+	}
+
+	if t, ok := obj["type"]; ok {
+		switch t := t.(type) {
+		case string:
+			n.types = []string{t}
+		case []interface{}:
+			for _, item := range t {
+				s, ok := item.(string)
+				if !ok {
+					return nil, fail("type", "must be a string or an array of strings")
+				}
+				n.types = append(n.types, s)
+			}
+		default:
+			return nil, fail("type", "must be a string or an array of strings")
+		}
+		for _, t := range n.types {
+			switch t {
+			case "null", "boolean", "object", "array", "number", "integer", "string":
+			default:
+				return nil, fail("type", "has unknown type "+strconv.Quote(t))
+			}
+		}
+	}
+	if e, ok := obj["enum"]; ok {
+		list, ok := e.([]interface{})
+		if !ok {
+			return nil, fail("enum", "must be an array")
+		}
+		n.enum = list
+	}
+	if cv, ok := obj["const"]; ok {
+		n.hasConst = true
+		n.constVal = cv
+	}
+
+	// Subschemas, compiled with their JSON Pointer so $ref can find them
+	schemaMap := func(keyword string) (map[string]*node, error) {
+		raw, ok := obj[keyword]
+		if !ok {
+			return nil, nil
+		}
+		m, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fail(keyword, "must be an object")
+		}
+		nodes := make(map[string]*node, len(m))
+		for name, sub := range m {
+			compiled, err := c.compile(sub, ptr+"/"+keyword+"/"+escape(name))
+			if err != nil {
+				return nil, err
+			}
+			nodes[name] = compiled
+		}
+		return nodes, nil
+	}
+	schemaList := func(keyword string) ([]*node, error) {
+		raw, ok := obj[keyword]
+		if !ok {
+			return nil, nil
+		}
+		list, ok := raw.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fail(keyword, "must be a non-empty array")
+		}
+		nodes := make([]*node, len(list))
+		for i, sub := range list {
+			if nodes[i], err = c.compile(sub, ptr+"/"+keyword+"/"+strconv.Itoa(i)); err != nil {
+				return nil, err
+			}
+		}
+		return nodes, nil
+	}
+	schemaOne := func(keyword string) (*node, error) {
+		raw, ok := obj[keyword]
+		if !ok {
+			return nil, nil
+		}
+		return c.compile(raw, ptr+"/"+keyword)
+	}
+
+	for _, keyword := range []string{"$defs", "definitions"} {
+		if _, err := schemaMap(keyword); err != nil {
+			return nil, err
+		}
+	}
+	if n.properties, err = schemaMap("properties"); err != nil {
+		return nil, err
+	}
+	patterns, err := schemaMap("patternProperties")
+	if err != nil {
+		return nil, err
+	}
+	for expr, sub := range patterns {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fail("patternProperties", "has invalid pattern: "+err.Error())
+		}
+		n.patternProperties = append(n.patternProperties, patternNode{pattern: re, schema: sub})
+	}
+	if n.additionalProperties, err = schemaOne("additionalProperties"); err != nil {
+		return nil, err
+	}
+	if r, ok := obj["required"]; ok {
+		list, ok := r.([]interface{})
+		if !ok {
+			return nil, fail("required", "must be an array of strings")
+		}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok {
+				return nil, fail("required", "must be an array of strings")
+			}
+			n.required = append(n.required, s)
+		}
+	}
+	if n.items, err = schemaOne("items"); err != nil {
+		return nil, err
+	}
+	if n.prefixItems, err = schemaList("prefixItems"); err != nil {
+		return nil, err
+	}
+	if u, ok := obj["uniqueItems"]; ok {
+		b, ok := u.(bool)
+		if !ok {
+			return nil, fail("uniqueItems", "must be a boolean")
+		}
+		n.uniqueItems = b
+	}
+
+	counts := map[string]**int{
+		"minProperties": &n.minProperties,
+		"maxProperties": &n.maxProperties,
+		"minItems":      &n.minItems,
+		"maxItems":      &n.maxItems,
+		"minLength":     &n.minLength,
+		"maxLength":     &n.maxLength,
+	}
+	for keyword, field := range counts {
+		raw, ok := obj[keyword]
+		if !ok {
+			continue
+		}
+		num, ok := raw.(json.Number)
+		if !ok {
+			return nil, fail(keyword, "must be a non-negative integer")
+		}
+		i, err := strconv.Atoi(num.String())
+		if err != nil || i < 0 {
+			return nil, fail(keyword, "must be a non-negative integer")
+		}
+		*field = &i
+	}
+
+	numbers := map[string]**big.Rat{
+		"minimum":          &n.minimum,
+		"maximum":          &n.maximum,
+		"exclusiveMinimum": &n.exclusiveMinimum,
+		"exclusiveMaximum": &n.exclusiveMaximum,
+		"multipleOf":       &n.multipleOf,
+	}
+	for keyword, field := range numbers {
+		raw, ok := obj[keyword]
+		if !ok {
+			continue
+		}
+		r, ok := rat(raw)
+		if !ok {
+			return nil, fail(keyword, "must be a number")
+		}
+		*field = r
+	}
+	if n.multipleOf != nil && n.multipleOf.Sign() <= 0 {
+		return nil, fail("multipleOf", "must be greater than zero")
+	}
+
+	if p, ok := obj["pattern"]; ok {
+		s, ok := p.(string)
+		if !ok {
+			return nil, fail("pattern", "must be a string")
+		}
+		if n.pattern, err = regexp.Compile(s); err != nil {
+			return nil, fail("pattern", "is invalid: "+err.Error())
+		}
+	}
+
+	if n.allOf, err = schemaList("allOf"); err != nil {
+		return nil, err
+	}
+	if n.anyOf, err = schemaList("anyOf"); err != nil {
+		return nil, err
+	}
+	if n.oneOf, err = schemaList("oneOf"); err != nil {
+		return nil, err
+	}
+	if n.not, err = schemaOne("not"); err != nil {
+		return nil, err
+	}
+
+	if r, ok := obj["$ref"]; ok {
+		ref, ok := r.(string)
+		if !ok || (ref != "#" && !strings.HasPrefix(ref, "#/")) {
+			return nil, fail("$ref", "must be a local reference such as \"#/$defs/name\"")
+		}
+		n.ref = ref
+		c.refs = append(c.refs, n)
+	}
+
+	return n, nil
+}
+
+func (n *node) validate(v interface{}, path string, depth int, st *validation) {
+	*st.steps++
+	if st.done() {
+		return
+	}
+	if depth > maxDepth {
+		st.fail(path, "schema nesting is too deep")
+		return
+	}
+	if n.always != nil {
+		if !*n.always {
+			st.fail(path, "no value is allowed here")
+		}
+		return
+	}
+	fail := func(format string, args ...interface{}) {
+		st.fail(path, fmt.Sprintf(format, args...))
+	}
+
+	if n.resolved != nil {
+		if n.resolved.validate(v, path, depth+1, st); st.done() {
+			return
+		}
+	}
+
+	if len(n.types) > 0 && !matchesType(v, n.types) {
+		fail("expected %s, got %s", strings.Join(n.types, " or "), typeOf(v))
+		// The remaining keywords would only pile up confusing errors
+		return
+	}
+	if n.enum != nil {
+		found := false
+		for _, allowed := range n.enum {
+			if equal(v, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("must be one of %s", describe(n.enum))
+		}
+	}
+	if n.hasConst && !equal(v, n.constVal) {
+		fail("must be %s", describe([]interface{}{n.constVal}))
+	}
+
+	if st.done() {
+		return
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		n.validateObject(v, path, depth, st)
+	case []interface{}:
+		n.validateArray(v, path, depth, st)
+	case string:
+		length := utf8.RuneCountInString(v)
+		if n.minLength != nil && length < *n.minLength {
+			fail("must be at least %d characters long", *n.minLength)
+		}
+		if n.maxLength != nil && length > *n.maxLength {
+			fail("must be at most %d characters long", *n.maxLength)
+		}
+		if n.pattern != nil && !n.pattern.MatchString(v) {
+			fail("must match the pattern %q", n.pattern.String())
+		}
+	case json.Number:
+		r, ok := rat(v)
+		if !ok {
+			fail("is not a valid number")
+			break
+		}
+		if n.minimum != nil && r.Cmp(n.minimum) < 0 {
+			fail("must be at least %s", formatRat(n.minimum))
+		}
+		if n.maximum != nil && r.Cmp(n.maximum) > 0 {
+			fail("must be at most %s", formatRat(n.maximum))
+		}
+		if n.exclusiveMinimum != nil && r.Cmp(n.exclusiveMinimum) <= 0 {
+			fail("must be greater than %s", formatRat(n.exclusiveMinimum))
+		}
+		if n.exclusiveMaximum != nil && r.Cmp(n.exclusiveMaximum) >= 0 {
+			fail("must be less than %s", formatRat(n.exclusiveMaximum))
+		}
+		if n.multipleOf != nil && !new(big.Rat).Quo(r, n.multipleOf).IsInt() {
+			fail("must be a multiple of %s", formatRat(n.multipleOf))
+		}
+	}
+
+	if st.done() {
+		return
+	}
+
+	for _, sub := range n.allOf {
+		if sub.validate(v, path, depth+1, st); st.done() {
+			return
+		}
+	}
+	if n.anyOf != nil {
+		matched := false
+		for _, sub := range n.anyOf {
+			if sub.valid(v, depth, st) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("must match at least one of the allowed schemas")
+		}
+	}
+	if n.oneOf != nil && !st.done() {
+		matched := 0
+		for _, sub := range n.oneOf {
+			if sub.valid(v, depth, st) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			fail("must match exactly one of the allowed schemas, matched %d", matched)
+		}
+	}
+	if n.not != nil && !st.done() && n.not.valid(v, depth, st) {
+		fail("must not match the disallowed schema")
+	}
+}
+
+func (n *node) validateObject(v map[string]interface{}, path string, depth int, st *validation) {
+	for _, name := range n.required {
+		if _, ok := v[name]; !ok {
+			st.fail(path+"/"+escape(name), "is required")
+		}
+	}
+	if n.minProperties != nil && len(v) < *n.minProperties {
+		st.fail(path, fmt.Sprintf("must have at least %d properties", *n.minProperties))
+	}
+	if n.maxProperties != nil && len(v) > *n.maxProperties {
+		st.fail(path, fmt.Sprintf("must have at most %d properties", *n.maxProperties))
+	}
+
+	for _, name := range sortedKeys(v) {
+		if st.done() {
+			return
+		}
+		value := v[name]
+		propertyPath := path + "/" + escape(name)
+		matched := false
+		if sub, ok := n.properties[name]; ok {
+			sub.validate(value, propertyPath, depth+1, st)
+			matched = true
+		}
+		for _, pattern := range n.patternProperties {
+			if pattern.pattern.MatchString(name) {
+				pattern.schema.validate(value, propertyPath, depth+1, st)
+				matched = true
+			}
+		}
+		if !matched && n.additionalProperties != nil {
+			if n.additionalProperties.always != nil && !*n.additionalProperties.always {
+				st.fail(propertyPath, "is not an allowed property")
+				continue
+			}
+			n.additionalProperties.validate(value, propertyPath, depth+1, st)
+		}
+	}
+}
+
+func (n *node) validateArray(v []interface{}, path string, depth int, st *validation) {
+	if n.minItems != nil && len(v) < *n.minItems {
+		st.fail(path, fmt.Sprintf("must have at least %d items", *n.minItems))
+	}
+	if n.maxItems != nil && len(v) > *n.maxItems {
+		st.fail(path, fmt.Sprintf("must have at most %d items", *n.maxItems))
+	}
+	for i, item := range v {
+		if st.done() {
+			return
+		}
+		itemPath := path + "/" + strconv.Itoa(i)
+		if i < len(n.prefixItems) {
+			n.prefixItems[i].validate(item, itemPath, depth+1, st)
+		} else if n.items != nil {
+			n.items.validate(item, itemPath, depth+1, st)
+		}
+	}
+	if n.uniqueItems && !st.done() {
+		for i := 1; i < len(v); i++ {
+			for j := 0; j < i; j++ {
+				if equal(v[i], v[j]) {
+					st.fail(path+"/"+strconv.Itoa(i), fmt.Sprintf("duplicates item %d", j))
+					break
+				}
+			}
+		}
+	}
+}
+
+// valid reports whether v matches n, stopping at the first error instead of
+// collecting the reasons.
+func (n *node) valid(v interface{}, depth int, st *validation) bool {
+	check := &validation{first: true, steps: st.steps}
+	n.validate(v, "", depth+1, check)
+	return len(check.errs) == 0
+}
+
+func matchesType(v interface{}, types []string) bool {
+	actual := typeOf(v)
+	for _, t := range types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if r, ok := rat(v); ok && r.IsInt() {
+			return "integer"
+		}
+		return "number"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// rat returns the exact value of a decoded number. Numbers that are too long
+// to parse cheaply are refused.
+func rat(v interface{}) (*big.Rat, bool) {
+	num, ok := v.(json.Number)
+	if !ok || !boundedNumber(num.String()) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(num.String())
+}
+
+// formatRat formats a number from a schema the way it was most likely written.
+func formatRat(r *big.Rat) string {
+	if r.IsInt() {
+		return r.RatString()
+	}
+	return strings.TrimRight(strings.TrimRight(r.FloatString(20), "0"), ".")
+}
+
+// equal compares two decoded JSON values, numbers by value.
+func equal(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		ra, ok := rat(a)
+		if !ok {
+			return a == b
+		}
+		rb, ok := rat(b)
+		return ok && ra.Cmp(rb) == 0
+	case map[string]interface{}:
+		m, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(m) {
+			return false
+		}
+		for key, value := range a {
+			other, ok := m[key]
+			if !ok || !equal(value, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		list, ok := b.([]interface{})
+		if !ok || len(a) != len(list) {
+			return false
+		}
+		for i := range a {
+			if !equal(a[i], list[i]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+func describe(values []interface{}) string {
+	data, _ := json.Marshal(values)
+	s := string(data)
+	if len(values) == 1 {
+		s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	}
+	return s
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// escape escapes a JSON Pointer reference token.
+func escape(token string) string {
+	return pointerEscaper.Replace(token)
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
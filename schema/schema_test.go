@@ -0,0 +1,271 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package schema
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeywords(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		valid   []string
+		invalid []string
+	}{
+		{"boolean true", `true`, []string{`1`, `null`, `{}`}, nil},
+		{"boolean false", `false`, nil, []string{`1`, `null`, `{}`}},
+		{"type", `{"type":"string"}`, []string{`"a"`}, []string{`1`, `null`, `[]`}},
+		{"type list", `{"type":["string","null"]}`, []string{`"a"`, `null`}, []string{`1`, `false`}},
+		{"integer", `{"type":"integer"}`, []string{`1`, `-3`, `2.0`, `1e2`}, []string{`1.5`, `"1"`}},
+		{"number", `{"type":"number"}`, []string{`1`, `1.5`, `-2e-3`}, []string{`"1"`, `true`}},
+		{"enum", `{"enum":["a",1,null]}`, []string{`"a"`, `1`, `1.0`, `null`}, []string{`"b"`, `2`, `false`}},
+		{"const", `{"const":{"a":[1,2]}}`, []string{`{"a":[1,2]}`, `{"a":[1.0,2]}`}, []string{`{"a":[2,1]}`, `{"a":[1,2],"b":1}`}},
+		{
+			"properties",
+			`{"properties":{"name":{"type":"string"}},"required":["name"]}`,
+			[]string{`{"name":"a"}`, `{"name":"a","other":1}`, `1`},
+			[]string{`{}`, `{"name":1}`},
+		},
+		{
+			"additionalProperties false",
+			`{"properties":{"a":true},"additionalProperties":false}`,
+			[]string{`{}`, `{"a":1}`},
+			[]string{`{"b":1}`},
+		},
+		{
+			"additionalProperties schema",
+			`{"properties":{"a":true},"additionalProperties":{"type":"integer"}}`,
+			[]string{`{"a":"x","b":1}`},
+			[]string{`{"b":"x"}`},
+		},
+		{
+			"patternProperties",
+			`{"patternProperties":{"^x-":{"type":"string"}},"additionalProperties":false}`,
+			[]string{`{"x-a":"1"}`},
+			[]string{`{"x-a":1}`, `{"a":"1"}`},
+		},
+		{"minProperties", `{"minProperties":1}`, []string{`{"a":1}`}, []string{`{}`}},
+		{"maxProperties", `{"maxProperties":1}`, []string{`{}`, `{"a":1}`}, []string{`{"a":1,"b":2}`}},
+		{"items", `{"items":{"type":"integer"}}`, []string{`[]`, `[1,2]`}, []string{`[1,"2"]`}},
+		{
+			"prefixItems",
+			`{"prefixItems":[{"type":"string"}],"items":{"type":"integer"}}`,
+			[]string{`["a"]`, `["a",1,2]`},
+			[]string{`[1]`, `["a","b"]`},
+		},
+		{"minItems", `{"minItems":2}`, []string{`[1,2]`}, []string{`[1]`}},
+		{"maxItems", `{"maxItems":1}`, []string{`[]`, `[1]`}, []string{`[1,2]`}},
+		{"uniqueItems", `{"uniqueItems":true}`, []string{`[1,2]`, `[{"a":1},{"a":2}]`}, []string{`[1,1.0]`, `[{"a":1},{"a":1}]`}},
+		{"minLength", `{"minLength":2}`, []string{`"ab"`, `"é€"`}, []string{`"a"`, `"é"`}},
+		{"maxLength", `{"maxLength":2}`, []string{`"ab"`, `"é€"`}, []string{`"abc"`}},
+		{"pattern", `{"pattern":"^[a-z]+$"}`, []string{`"abc"`, `1`}, []string{`"ABC"`, `""`}},
+		{"minimum", `{"minimum":1.5}`, []string{`1.5`, `2`}, []string{`1.4999`}},
+		{"maximum", `{"maximum":10}`, []string{`10`, `-1`}, []string{`10.0001`}},
+		{"exclusiveMinimum", `{"exclusiveMinimum":0}`, []string{`0.001`}, []string{`0`, `-1`}},
+		{"exclusiveMaximum", `{"exclusiveMaximum":0}`, []string{`-0.001`}, []string{`0`}},
+		{"multipleOf", `{"multipleOf":0.1}`, []string{`0.3`, `7`, `-1.2`}, []string{`0.35`}},
+		{"large integers", `{"maximum":18446744073709551616}`, []string{`18446744073709551615`}, []string{`18446744073709551617`}},
+		{"allOf", `{"allOf":[{"minimum":1},{"maximum":3}]}`, []string{`2`}, []string{`0`, `4`}},
+		{"anyOf", `{"anyOf":[{"type":"string"},{"minimum":5}]}`, []string{`"a"`, `6`}, []string{`1`}},
+		{"oneOf", `{"oneOf":[{"type":"integer"},{"minimum":5}]}`, []string{`1`, `5.5`}, []string{`6`, `1.5`}},
+		{"not", `{"not":{"type":"null"}}`, []string{`1`}, []string{`null`}},
+		{
+			"$ref",
+			`{"$defs":{"id":{"type":"integer","minimum":1}},"properties":{"id":{"$ref":"#/$defs/id"}}}`,
+			[]string{`{"id":1}`},
+			[]string{`{"id":0}`, `{"id":"1"}`},
+		},
+		{
+			"recursive $ref",
+			`{"type":"object","properties":{"next":{"$ref":"#"}},"additionalProperties":false}`,
+			[]string{`{}`, `{"next":{"next":{}}}`},
+			[]string{`{"next":{"other":1}}`},
+		},
+		{"annotations", `{"format":"email","title":"x"}`, []string{`"not an email"`}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := Compile([]byte(tt.schema))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, doc := range tt.valid {
+				if err := s.ValidateJSON([]byte(doc)); err != nil {
+					t.Errorf("%s rejected: %v", doc, err)
+				}
+			}
+			for _, doc := range tt.invalid {
+				err := s.ValidateJSON([]byte(doc))
+				var problems Errors
+				if !errors.As(err, &problems) {
+					t.Errorf("%s accepted, err = %v", doc, err)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorPaths(t *testing.T) {
+	s := MustCompile(`{
+		"properties": {
+			"user": {"properties": {"a/b": {"type": "string"}}, "required": ["name"]},
+			"tags": {"items": {"maxLength": 3}}
+		}
+	}`)
+	err := s.ValidateJSON([]byte(`{"user":{"a/b":1},"tags":["ok","long"]}`))
+	var problems Errors
+	if !errors.As(err, &problems) {
+		t.Fatalf("err = %v, want Errors", err)
+	}
+	want := []string{"/tags/1", "/user/name", "/user/a~1b"}
+	if len(problems) != len(want) {
+		t.Fatalf("got %v, want errors at %v", problems, want)
+	}
+	for i, path := range want {
+		if problems[i].Path != path {
+			t.Errorf("error %d at %q, want %q", i, problems[i].Path, path)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	s := MustCompile(`{"properties":{"count":{"type":"integer","minimum":1}}}`)
+	if err := s.Validate(map[string]interface{}{"count": 2.0}); err != nil {
+		t.Errorf("decoded value rejected: %v", err)
+	}
+	if err := s.Validate(map[string]int{"count": 0}); err == nil {
+		t.Error("decoded value accepted")
+	}
+	if err := s.Validate(func() {}); err == nil || errors.As(err, new(Errors)) {
+		t.Errorf("err = %v, want an encoding error", err)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []string{
+		`{`,
+		`1`,
+		`{"type":"text"}`,
+		`{"minLength":-1}`,
+		`{"minLength":1.5}`,
+		`{"minimum":"1"}`,
+		`{"multipleOf":0}`,
+		`{"pattern":"("}`,
+		`{"$ref":"other.json"}`,
+		`{"$ref":"#/$defs/missing"}`,
+		`{"minimum":1e999999}`,
+		`{"$ref":"#"}`,
+		`{"not":{"$ref":"#"}}`,
+		`{"$defs":{"a":{"anyOf":[{"$ref":"#/$defs/a"},{"$ref":"#/$defs/a"}]}},"$ref":"#/$defs/a"}`,
+		`{"$defs":{"a":{"allOf":[{"$ref":"#/$defs/b"}]},"b":{"oneOf":[{"$ref":"#/$defs/a"}]}}}`,
+	}
+	for _, schema := range tests {
+		if _, err := Compile([]byte(schema)); err == nil {
+			t.Errorf("Compile(%s) succeeded", schema)
+		}
+	}
+}
+
+func TestExpensiveSchemas(t *testing.T) {
+	nested := func(depth int, leaf string) string {
+		return strings.Repeat(`{"z":3,"c":`, depth) + leaf + strings.Repeat("}", depth)
+	}
+	tests := []struct {
+		name   string
+		schema string
+		doc    string
+		reason string
+	}{
+		{
+			"anyOf failing early",
+			`{"$defs":{"n":{"anyOf":[{"type":"object","properties":{"c":{"$ref":"#/$defs/n"}},"required":["x"]},{"type":"object","properties":{"c":{"$ref":"#/$defs/n"}}}]}},"$ref":"#/$defs/n"}`,
+			nested(22, `{}`),
+			"",
+		},
+		{
+			"anyOf failing after recursing",
+			`{"$defs":{"n":{"anyOf":[{"properties":{"c":{"$ref":"#/$defs/n"},"z":{"const":1}}},{"properties":{"c":{"$ref":"#/$defs/n"},"z":{"const":2}}}]}},"$ref":"#/$defs/n"}`,
+			nested(30, `{}`),
+			"validation is too expensive",
+		},
+	}
+	for _, tt := range tests {
+		s := MustCompile(tt.schema)
+		start := time.Now()
+		err := s.ValidateJSON([]byte(tt.doc))
+		// Unbounded, these take minutes
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("%s: validation took %v", tt.name, elapsed)
+		}
+		if tt.reason == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: err = %v, want %q", tt.name, err, tt.reason)
+		}
+	}
+}
+
+func TestLargeNumbers(t *testing.T) {
+	s := MustCompile(`{"type":"array","items":{"type":"integer","multipleOf":3},"uniqueItems":true}`)
+	doc := "[" + strings.TrimSuffix(strings.Repeat("9e999999,", 250), ",") + "]"
+
+	start := time.Now()
+	err := s.ValidateJSON([]byte(doc))
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("validation took %v", elapsed)
+	}
+	var problems Errors
+	if !errors.As(err, &problems) || !strings.Contains(problems.Error(), "too large") {
+		t.Errorf("err = %v, want a too large error", err)
+	}
+
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{"1e308", true},
+		{"-1.5E-512", true},
+		{"1e+0512", true},
+		{"1e513", false},
+		{"1e-513", false},
+		{"1e00000000000000001", true},
+		{"1" + strings.Repeat("0", maxNumberDigits-1), true},
+		{"1" + strings.Repeat("0", maxNumberDigits), false},
+		{"0." + strings.Repeat("0", maxNumberDigits-1), true},
+		{"0." + strings.Repeat("0", maxNumberDigits), false},
+	}
+	for _, tt := range tests {
+		if got := boundedNumber(tt.number); got != tt.valid {
+			t.Errorf("boundedNumber(%.30s) = %v, want %v", tt.number, got, tt.valid)
+		}
+	}
+}
@@ -30,11 +30,28 @@ import (
 type Session struct {
 	Username    string
 	connections map[string]*Connection
+	identity    *Identity
 	sync.Mutex
 }
 
+// Identity returns the identity the session's user last authenticated with,
+// or nil when the session was created without authentication.
+func (s *Session) Identity() *Identity {
+	s.Lock()
+	defer s.Unlock()
+	return s.identity
+}
+
+func (s *Session) setIdentity(identity *Identity) {
+	s.Lock()
+	defer s.Unlock()
+	s.identity = identity
+}
+
+// HasSession reports whether the session belongs to a user with at least one
+// connection. It is safe to call on the nil session of a cleared connection.
 func (s *Session) HasSession() bool {
-	return s.Username != "" && len(s.connections) > 0
+	return s != nil && s.Username != "" && len(s.connections) > 0
 }
 
 func (s *Session) Emit(msg *common.Message) {
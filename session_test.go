@@ -0,0 +1,77 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+func TestSessionEmitMixedCodecs(t *testing.T) {
+	s, handler, url := newTestServer(t, &Config{Codecs: []common.Codec{common.JSON, common.MsgPack, common.CBOR}})
+
+	clients := make(map[common.Codec]*websocket.Conn)
+	for _, codec := range []common.Codec{common.JSON, common.MsgPack, common.CBOR} {
+		dialer := websocket.Dialer{Subprotocols: common.ProtocolNames(common.ProtocolsFor([]common.Codec{codec}))}
+		ws, _, err := dialer.Dial(url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients[codec] = ws
+
+		conn := (<-handler.opened).Connection
+		if codec == common.JSON {
+			err = s.AddSession("alice", conn)
+		} else {
+			err = s.UpdateSession("alice", conn)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s.Sessions["alice"].Emit(&common.Message{EventName: "note", Data: json.RawMessage(`{"text":"hi"}`)})
+
+	for codec, ws := range clients {
+		ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("%s: %v", codec.Name(), err)
+		}
+		var msg common.Message
+		if err := codec.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("%s: Unmarshal: %v", codec.Name(), err)
+		}
+		var note struct {
+			Text string `json:"text"`
+		}
+		if err := codec.Unmarshal(msg.Data, &note); err != nil || note.Text != "hi" {
+			t.Errorf("%s: got %+v, %v", codec.Name(), note, err)
+		}
+	}
+}
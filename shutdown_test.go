@@ -0,0 +1,134 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/syleron/sockets/common"
+)
+
+func TestShutdownSendsGoingAway(t *testing.T) {
+	s, handler, url := newTestServer(t, &Config{})
+	ws := dialTestServer(t, url)
+	<-handler.opened
+
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	// Reading the close frame also answers it
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("read = %v, want going away close", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Shutdown = %v", err)
+	}
+
+	select {
+	case <-handler.closed:
+	default:
+		t.Error("ConnectionClosed was not called before Shutdown returned")
+	}
+
+	if _, _, err := websocket.DefaultDialer.Dial(url, nil); err == nil {
+		t.Error("upgrade accepted after Shutdown")
+	}
+}
+
+func TestShutdownWaitsForHandlers(t *testing.T) {
+	s, handler, url := newTestServer(t, &Config{})
+	started := make(chan struct{})
+	release := make(chan struct{})
+	s.HandleEvent("slow", func(msg *common.Message, ctx *Context) {
+		close(started)
+		<-release
+	}, false)
+
+	ws := dialTestServer(t, url)
+	<-handler.opened
+	ws.WriteJSON(common.Message{EventName: "slow", Data: json.RawMessage(`null`)})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown = %v, want %v", err, context.DeadlineExceeded)
+	}
+	close(release)
+}
+
+func TestShutdownOnSignal(t *testing.T) {
+	shutdown := make(chan error, 1)
+	s, handler, url := newTestServer(t, &Config{
+		HandleSignals: true,
+		OnShutdown:    func(err error) { shutdown <- err },
+	})
+	ws := dialTestServer(t, url)
+	<-handler.opened
+
+	s.interrupt <- os.Interrupt
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := ws.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("read = %v, want going away close", err)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatalf("OnShutdown got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnShutdown was not called")
+	}
+}
+
+func TestShutdownStopsSignalHandling(t *testing.T) {
+	shutdown := make(chan error, 1)
+	s, _, _ := newTestServer(t, &Config{
+		HandleSignals: true,
+		OnShutdown:    func(err error) { shutdown <- err },
+	})
+	s.Close()
+
+	// The signal is no longer handled once the server was closed
+	select {
+	case s.interrupt <- os.Interrupt:
+	default:
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("closed server shut down again on a signal")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
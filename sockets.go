@@ -23,12 +23,12 @@
 package sockets
 
 import (
-	"crypto/x509"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/gorilla/websocket"
+	"github.com/rs/xid"
 	"github.com/syleron/sockets/common"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -36,6 +36,9 @@ import (
 	"time"
 )
 
+// ErrServerClosed is returned by HandleConnection once Shutdown or Close has been called.
+var ErrServerClosed = errors.New("sockets: server closed")
+
 type DataHandler interface {
 	// NewConnection Client connected handler
 	NewConnection(ctx *Context)
@@ -49,34 +52,28 @@ type Sockets struct {
 	Sessions      map[string]*Session
 	broadcastChan chan Broadcast
 	interrupt     chan os.Signal
+	stopSignals   chan struct{}
+	stopOnce      sync.Once
 	handler       DataHandler
 	config        *Config
+	events        *eventRegistry
+	rooms         map[string]*roomIndex
+	upgrader      websocket.Upgrader
+	origins       *originPolicy
+	userLimits    *userLimiter
+	nodeID        string
+	presence      *presenceTracker
+	parked        map[string]*Connection
+	closing       bool
+	wg            sync.WaitGroup
 	sync.RWMutex
 }
 
-type Context struct {
-	*Connection
-	UUID      string
-	PeerCerts []*x509.Certificate
-}
-
 type Broadcast struct {
 	message *common.Message
 	context *Context
 }
 
-type Room struct {
-	Name    string `json:"name"`
-	Channel string `json:"channel"`
-}
-
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		// TODO: Add a check for the origin of the request to prevent CSRF attacks.
-		return true
-	},
-}
-
 func New(handler DataHandler, c *Config) *Sockets {
 	c.MergeDefaults()
 
@@ -84,62 +81,253 @@ func New(handler DataHandler, c *Config) *Sockets {
 		Connections:   make(map[string]*Connection),
 		Sessions:      make(map[string]*Session),
 		broadcastChan: make(chan Broadcast),
-		interrupt:     make(chan os.Signal, 1),
 		handler:       handler,
 		config:        c,
+		events:        newEventRegistry(),
+		rooms:         make(map[string]*roomIndex),
+		parked:        make(map[string]*Connection),
+		upgrader: websocket.Upgrader{
+			EnableCompression: c.EnableCompression,
+			CheckOrigin: func(r *http.Request) bool {
+				// Origins are checked by HandleConnection before upgrading
+				return true
+			},
+		},
+		origins:    newOriginPolicy(c),
+		userLimits: newUserLimiter(),
+		nodeID:     xid.New().String(),
+	}
+
+	// Advertise every configured protocol, in order of preference
+	sockets.upgrader.Subprotocols = common.ProtocolNames(c.Protocols)
+
+	if c.Presence {
+		sockets.presence = newPresenceTracker()
 	}
 
-	signal.Notify(sockets.interrupt, os.Interrupt)
-	go sockets.manageInterrupts()
+	if c.Authenticator != nil {
+		sockets.events.add(common.ReauthEvent, &Event{EventFunc: sockets.handleReauth})
+	}
+
+	if c.Adapter != nil {
+		c.Adapter.Subscribe(sockets.handleClusterMessage)
+		if sockets.presence != nil {
+			// Learn who is present on the nodes already running
+			sockets.publish(&ClusterMessage{Type: ClusterPresence, Event: presenceSyncEvent}, nil)
+		}
+	}
+
+	if c.HandleSignals {
+		sockets.interrupt = make(chan os.Signal, 1)
+		sockets.stopSignals = make(chan struct{})
+		signal.Notify(sockets.interrupt, os.Interrupt)
+		go sockets.manageInterrupts()
+	}
 
 	return sockets
 }
 
+// Close immediately closes every connection without waiting for them to drain.
+// Use Shutdown for a graceful stop.
 func (s *Sockets) Close() {
-	s.RLock()
-	defer s.RUnlock()
+	s.stopHandlingSignals()
 
+	s.Lock()
+	s.closing = true
 	for _, c := range s.Connections {
 		if c.Conn != nil {
 			c.Conn.Close()
 		}
 	}
+	s.Unlock()
 
-	log.Println("All connections closed.")
-	os.Exit(0)
+	s.expireAllParked()
+	s.config.Logger.Info("all connections closed")
 }
 
-func (s *Sockets) HandleEvent(pattern string, handler EventFunc, protected bool) {
-	if events == nil {
-		events = make(map[string]*Event)
+// Shutdown gracefully stops the server. New upgrades are refused, every
+// connection is sent a "going away" close frame and Shutdown then waits for
+// in-flight event handlers and ConnectionClosed callbacks to finish. If ctx
+// expires first the remaining connections are closed forcefully and the
+// context's error is returned.
+func (s *Sockets) Shutdown(ctx context.Context) error {
+	s.stopHandlingSignals()
+
+	s.Lock()
+	s.closing = true
+	connections := make([]*Connection, 0, len(s.Connections))
+	for _, c := range s.Connections {
+		connections = append(connections, c)
 	}
+	s.Unlock()
 
-	events[pattern] = &Event{
-		EventFunc: handler,
-		Protected: protected,
+	for _, c := range connections {
+		c.closeWithCode(websocket.CloseGoingAway, "server shutting down")
 	}
+	// Nobody can resume once we are shutting down
+	s.expireAllParked()
+
+	drained := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+		s.RLock()
+		for _, c := range s.Connections {
+			if c.Conn != nil {
+				c.Conn.Close()
+			}
+		}
+		s.RUnlock()
+		return ctx.Err()
+	}
+}
+
+// HandleEvent registers the handler for an event. Middleware passed here only
+// applies to this event and runs after any middleware registered with Use.
+func (s *Sockets) HandleEvent(pattern string, handler EventFunc, protected bool, middleware ...Middleware) {
+	s.events.add(pattern, &Event{
+		EventFunc:  handler,
+		Protected:  protected,
+		Middleware: middleware,
+	})
+}
+
+// Use appends middleware that wraps every registered event handler.
+func (s *Sockets) Use(middleware ...Middleware) {
+	s.events.use(middleware...)
+}
+
+// RemoveEvent unregisters the handler for the given event.
+func (s *Sockets) RemoveEvent(pattern string) {
+	s.events.remove(pattern)
 }
 
+// manageInterrupts shuts the server down on SIGINT, then tells the
+// application through Config.OnShutdown.
 func (s *Sockets) manageInterrupts() {
-	<-s.interrupt
-	log.Println("Received interrupt signal, shutting down...")
-	s.Close()
+	select {
+	case <-s.interrupt:
+	case <-s.stopSignals:
+	}
+	// A second interrupt kills the process as usual
+	signal.Stop(s.interrupt)
+	select {
+	case <-s.stopSignals:
+		// Stopped by Close or Shutdown, maybe as the signal arrived
+		return
+	default:
+	}
+	s.config.Logger.Info("received interrupt signal, shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	err := s.Shutdown(ctx)
+	cancel()
+	if err != nil {
+		s.config.Logger.Error("shutdown did not complete cleanly", "error", err)
+	}
+	if s.config.OnShutdown != nil {
+		s.config.OnShutdown(err)
+	}
+}
+
+// stopHandlingSignals stops watching for SIGINT once the server is stopped
+// by other means.
+func (s *Sockets) stopHandlingSignals() {
+	if s.stopSignals == nil {
+		return
+	}
+	s.stopOnce.Do(func() {
+		close(s.stopSignals)
+	})
 }
 
 func (s *Sockets) HandleConnection(w http.ResponseWriter, r *http.Request, realIP string) error {
-	ws, err := upgrader.Upgrade(w, r, nil)
+	if !s.origins.allowed(r) {
+		origin := r.Header.Get("Origin")
+		s.config.Logger.Warn("rejected websocket upgrade", "origin", origin, "remote_ip", r.RemoteAddr)
+		if s.config.OnOriginRejected != nil {
+			s.config.OnOriginRejected(r, origin)
+		}
+		s.config.Metrics.ConnectionRejected(RejectOrigin)
+		http.Error(w, "websocket origin not allowed", http.StatusForbidden)
+		return ErrOriginNotAllowed
+	}
+
+	var identity *Identity
+	if s.config.Authenticator != nil {
+		var err error
+		identity, err = s.config.Authenticator.Authenticate(r)
+		if err != nil {
+			s.config.Logger.Warn("rejected unauthenticated websocket upgrade", "remote_ip", r.RemoteAddr, "error", err)
+			s.config.Metrics.ConnectionRejected(RejectAuth)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+	}
+
+	// Track the connection so Shutdown can wait for it to drain
+	s.Lock()
+	if s.closing {
+		s.Unlock()
+		s.config.Metrics.ConnectionRejected(RejectShutdown)
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return ErrServerClosed
+	}
+	s.wg.Add(1)
+	s.Unlock()
+	defer s.wg.Done()
+
+	ws, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Printf("Failed to upgrade WebSocket: %v", err)
+		s.config.Logger.Warn("failed to upgrade websocket", "remote_ip", r.RemoteAddr, "error", err)
+		s.config.Metrics.ConnectionRejected(RejectUpgrade)
 		return fmt.Errorf("websocket upgrade error: %w", err)
 	}
 	newConnection := NewConnection()
 	newConnection.Conn = ws
-	newConnection.RealIP = determineRealIP(ws, realIP)
+	newConnection.server = s
+	newConnection.RealIP = determineRealIP(ws, realIP, s.config.Logger)
 	newConnection.Status = true
+	newConnection.protocol = common.FindProtocol(s.config.Protocols, ws.Subprotocol())
+	newConnection.identity = identity
+	if s.config.RateLimit != nil {
+		newConnection.limiter = newConnectionLimiter(s.config.RateLimit)
+	}
+	if s.config.CompressionLevel != 0 {
+		if err := ws.SetCompressionLevel(s.config.CompressionLevel); err != nil {
+			s.config.Logger.Warn("invalid compression level", "level", s.config.CompressionLevel, "error", err)
+		}
+	}
 
 	peerCerts := getPeerCertificates(r)
 
-	s.addConnection(newConnection.UUID, newConnection)
+	var parked *Connection
+	var lastSeq uint64
+	if s.config.Resume != nil {
+		parked, lastSeq = s.takeParked(r, identity)
+	}
+
+	if parked != nil {
+		// The client picks up where it left off, it is not a new connection
+		s.resumeConnection(parked, newConnection, lastSeq)
+		s.config.Logger.Debug("connection resumed", newConnection.logArgs()...)
+	} else {
+		if s.config.Resume != nil {
+			s.enableResume(newConnection)
+		}
+		s.addConnection(newConnection.UUID, newConnection)
+		s.config.Metrics.ConnectionOpened()
+		if identity != nil {
+			s.attachSession(identity.Username, newConnection)
+		}
+	}
+	s.scheduleExpiry(newConnection)
 
 	context := &Context{
 		Connection: newConnection,
@@ -147,7 +335,9 @@ func (s *Sockets) HandleConnection(w http.ResponseWriter, r *http.Request, realI
 		PeerCerts:  peerCerts,
 	}
 
-	s.handler.NewConnection(context)
+	if parked == nil {
+		s.handler.NewConnection(context)
+	}
 
 	ws.SetReadLimit(s.config.ReadLimitSize)
 	ws.SetReadDeadline(time.Now().Add(s.config.PongWait))
@@ -160,127 +350,134 @@ func (s *Sockets) HandleConnection(w http.ResponseWriter, r *http.Request, realI
 }
 
 func (s *Sockets) handleMessages(ws *websocket.Conn, context *Context) error {
+	// Consecutive messages that could not be decoded
+	malformed := 0
 	for {
+		_, data, err := ws.ReadMessage()
+		if err != nil {
+			if s.parkable(context.Connection, err) {
+				s.park(context.Connection)
+			} else {
+				s.closeWS(context.Connection)
+			}
+			return fmt.Errorf("error reading message: %w", err)
+		}
 		var msg common.Message
-		if err := ws.ReadJSON(&msg); err != nil {
-			s.closeWS(context.Connection)
-			return fmt.Errorf("error reading JSON: %w", err)
+		if err := context.Codec().Unmarshal(data, &msg); err != nil {
+			malformed++
+			s.config.Logger.Warn("failed to decode message", context.logArgs("consecutive", malformed, "error", err)...)
+			s.config.Metrics.MessageReceived("malformed", len(data))
+			if !s.allowEvent(&common.Message{}, context) {
+				continue
+			}
+			if limit := s.config.MaxMalformedMessages; limit > 0 && malformed >= limit {
+				context.closeWithCode(websocket.CloseUnsupportedData, "too many malformed messages")
+				continue
+			}
+			context.sendError(&common.Error{Code: common.CodeBadRequest, Message: "malformed message"})
+			continue
+		}
+		malformed = 0
+		s.config.Metrics.MessageReceived(s.events.label(msg.EventName), len(data))
+		msgContext := context.withMessage(&msg)
+		if !s.allowEvent(&msg, msgContext) {
+			continue
 		}
-		EventHandler(&msg, context)
+		s.EventHandler(&msg, msgContext)
 	}
 }
 
+// Broadcast emits to every connection, on every node of the cluster.
 func (s *Sockets) Broadcast(event string, data interface{}) {
-	s.broadcastHelper(func(c *Connection) bool {
-		return true // Always true, since we're broadcasting to all
-	}, event, data)
+	s.broadcastLocal(event, data)
+	s.publish(&ClusterMessage{Type: ClusterBroadcast, Event: event}, data)
 }
 
+// BroadcastToRoom emits to every member of the room except ctx, on every node
+// of the cluster.
 func (s *Sockets) BroadcastToRoom(roomName, event string, data interface{}, ctx *Context) {
-	s.broadcastHelper(func(c *Connection) bool {
-		return c.Room != nil && c.Room.Name == roomName && c.UUID != ctx.UUID
-	}, event, data)
+	s.broadcastToRoomLocal(roomName, ctx.UUID, event, data)
+	s.publish(&ClusterMessage{Type: ClusterRoom, Room: roomName, Exclude: ctx.UUID, Event: event}, data)
 }
 
+// BroadcastToRoomChannel emits to every member of the room channel except
+// ctx, on every node of the cluster.
 func (s *Sockets) BroadcastToRoomChannel(roomName, channelName, event string, data interface{}, ctx *Context) {
-	s.broadcastHelper(func(c *Connection) bool {
-		return c.Room != nil && c.Room.Name == roomName && c.Room.Channel == channelName && c.UUID != ctx.UUID
-	}, event, data)
+	s.broadcastToRoomChannelLocal(roomName, channelName, ctx.UUID, event, data)
+	s.publish(&ClusterMessage{Type: ClusterRoomChannel, Room: roomName, Channel: channelName, Exclude: ctx.UUID, Event: event}, data)
 }
 
-func (s *Sockets) broadcastHelper(filter func(*Connection) bool, event string, data interface{}) {
+// EmitToUser emits to every connection of the user's session, on every node
+// of the cluster.
+func (s *Sockets) EmitToUser(username, event string, data interface{}) {
+	s.emitToUserLocal(username, event, data)
+	s.publish(&ClusterMessage{Type: ClusterUser, Username: username, Event: event}, data)
+}
+
+func (s *Sockets) broadcastLocal(event string, data interface{}) {
 	s.RLock()
 	defer s.RUnlock()
 
-	for _, c := range s.Connections {
-		if c.Conn == nil {
-			continue
-		}
-
-		if filter(c) {
-			message := common.Response{
-				EventName: event,
-				Data:      data,
-			}
-
-			if err := c.Emit(message); err != nil {
-				log.Printf("Failed to emit message to UUID %s: %v", c.UUID, err)
-				continue
-			}
-		}
-	}
+	s.broadcastHelper(s.Connections, "", event, data)
 }
 
-func (s *Sockets) GetUserRoom(username, uuid string) (string, error) {
-	if username == "" || uuid == "" {
-		return "", errors.New("invalid input: username or UUID is empty")
-	}
-
+func (s *Sockets) broadcastToRoomLocal(roomName, exclude, event string, data interface{}) {
 	s.RLock()
 	defer s.RUnlock()
 
-	if session, ok := s.Sessions[username]; ok {
-		if conn, ok := session.connections[uuid]; ok && conn.Room != nil {
-			return conn.Room.Name, nil
-		}
+	if room, ok := s.rooms[roomName]; ok {
+		s.broadcastHelper(room.members, exclude, event, data)
 	}
-
-	return "", fmt.Errorf("unable to find room for user %s with UUID %s", username, uuid)
 }
 
-func (s *Sockets) JoinRoom(room, uuid string) error {
-	if room == "" || uuid == "" {
-		return errors.New("invalid input: room or UUID is empty")
-	}
-
-	s.Lock()
-	defer s.Unlock()
+func (s *Sockets) broadcastToRoomChannelLocal(roomName, channelName, exclude, event string, data interface{}) {
+	s.RLock()
+	defer s.RUnlock()
 
-	if conn, ok := s.Connections[uuid]; ok {
-		conn.Room = &Room{Name: room}
-		log.Printf("User with UUID %s joined room %s", uuid, room)
-		return nil
+	if room, ok := s.rooms[roomName]; ok {
+		s.broadcastHelper(room.channels[channelName], exclude, event, data)
 	}
-
-	return fmt.Errorf("unable to find client connection for UUID %s", uuid)
 }
 
-func (s *Sockets) LeaveRoom(uuid string) {
-	if uuid == "" {
-		log.Println("Attempted to leave room with empty UUID")
-		return
-	}
-
-	s.Lock()
-	defer s.Unlock()
+func (s *Sockets) emitToUserLocal(username, event string, data interface{}) {
+	s.RLock()
+	defer s.RUnlock()
 
-	if conn, ok := s.Connections[uuid]; ok && conn.Room != nil {
-		conn.Room = &Room{} // Effectively "leaving" the room by resetting it
-		log.Printf("User with UUID %s left the room", uuid)
+	if session, ok := s.Sessions[username]; ok {
+		s.broadcastHelper(session.connections, "", event, data)
 	}
 }
 
-func (s *Sockets) JoinRoomChannel(channel, uuid string) error {
-	if channel == "" || uuid == "" {
-		return errors.New("invalid input: channel or UUID is empty")
+// broadcastHelper emits to every connection in connections except the one
+// with the exclude UUID. The caller must hold at least a read lock.
+func (s *Sockets) broadcastHelper(connections map[string]*Connection, exclude, event string, data interface{}) {
+	message := common.Response{
+		EventName: event,
+		Data:      data,
 	}
 
-	s.Lock()
-	defer s.Unlock()
+	recipients := 0
+	for uuid, c := range connections {
+		if c.Conn == nil || uuid == exclude {
+			continue
+		}
 
-	if conn, ok := s.Connections[uuid]; ok && conn.Room != nil {
-		conn.Room.Channel = channel
-		log.Printf("User with UUID %s joined channel %s", uuid, channel)
-		return nil
+		recipients++
+		if err := c.Emit(message); err != nil {
+			s.config.Logger.Debug("failed to emit message", c.logArgs("event", event, "error", err)...)
+			continue
+		}
 	}
-	return fmt.Errorf("unable to find client connection for UUID %s", uuid)
+	s.config.Metrics.Broadcast(event, recipients)
 }
 
 func (s *Sockets) manageSessionAndConnection(conn *Connection) {
+	defer s.flushPresence()
+
 	s.Lock()
 	defer s.Unlock()
 
-	username := conn.Username
+	username := connectionUsername(conn)
 	uuid := conn.UUID
 
 	// Check if the session exists and manage the session if it does
@@ -290,13 +487,17 @@ func (s *Sockets) manageSessionAndConnection(conn *Connection) {
 		// If no more connections are left in the session, delete the session
 		if len(session.connections) == 0 {
 			if err := s.deleteSession(username); err != nil {
-				log.Printf("Error deleting session for user %s: %v", username, err)
+				s.config.Logger.Error("failed to delete session", "username", username, "error", err)
 			}
 		}
 	}
 
-	// Remove the connection from the global list
+	// Remove the connection from its rooms and the global list
+	s.leaveAllRooms(conn)
 	delete(s.Connections, uuid)
+	if username != "" {
+		s.announceSession(username)
+	}
 }
 
 func (s *Sockets) deleteSession(username string) error {
@@ -305,12 +506,36 @@ func (s *Sockets) deleteSession(username string) error {
 	}
 
 	delete(s.Sessions, username)
+	s.userLimits.remove(username)
+	s.config.Metrics.SessionsChanged(len(s.Sessions))
 	return nil
 }
 
+// clearSession removes conn from its session, deleting the session once it has
+// no connections left.
+func (s *Sockets) clearSession(conn *Connection) {
+	defer s.flushPresence()
+
+	s.Lock()
+	defer s.Unlock()
+
+	s.presenceLeaveAll(conn)
+	username := connectionUsername(conn)
+	if session, ok := s.Sessions[username]; ok && session == conn.Session {
+		session.removeConnection(conn.UUID)
+		if len(session.connections) == 0 {
+			if err := s.deleteSession(username); err != nil {
+				s.config.Logger.Error("failed to delete session", "username", username, "error", err)
+			}
+		}
+		s.announceSession(username)
+	}
+	conn.Session = nil
+}
+
 func (s *Sockets) addConnection(uuid string, conn *Connection) {
 	if uuid == "" || conn == nil {
-		log.Println("Invalid parameters: UUID is empty or Connection is nil")
+		s.config.Logger.Error("invalid parameters: UUID is empty or connection is nil")
 		return
 	}
 
@@ -319,34 +544,39 @@ func (s *Sockets) addConnection(uuid string, conn *Connection) {
 
 	// Check if there's already an existing connection with the same UUID
 	if existing, exists := s.Connections[uuid]; exists {
-		log.Printf("Warning: Connection with UUID %s already exists, closing existing connection.", uuid)
-		existing.Conn.Close() // Ensure the existing connection is properly closed
+		s.config.Logger.Warn("connection already exists, closing existing connection", existing.logArgs()...)
+		existing.close() // Ensure the existing connection is properly closed
 	}
 
-	// Start our pong handler
-	go conn.pongHandler(s.config.PingPeriod)
+	// Start our write pump, it also takes care of pings
+	conn.startWritePump(s.config)
+
+	// Shutdown may have started while this connection was upgrading
+	if s.closing {
+		conn.closeWithCode(websocket.CloseGoingAway, "server shutting down")
+	}
 
 	// Append our connection
 	s.Connections[uuid] = conn
-	log.Printf("Connection added with UUID %s", uuid)
+	s.config.Logger.Debug("connection added", conn.logArgs()...)
 }
 
 func (s *Sockets) removeConnection(uuid string) {
 	if uuid == "" {
-		log.Println("Attempted to remove connection with empty UUID")
+		s.config.Logger.Error("attempted to remove connection with empty UUID")
 		return
 	}
 
 	s.Lock()
 	if _, exists := s.Connections[uuid]; !exists {
 		s.Unlock()
-		log.Printf("No connection exists with UUID %s", uuid)
+		s.config.Logger.Warn("no connection exists", "uuid", uuid)
 		return
 	}
 
 	delete(s.Connections, uuid)
 	s.Unlock()
-	log.Printf("Connection removed with UUID %s", uuid)
+	s.config.Logger.Debug("connection removed", "uuid", uuid)
 }
 
 func (s *Sockets) AddSession(username string, conn *Connection) error {
@@ -354,6 +584,8 @@ func (s *Sockets) AddSession(username string, conn *Connection) error {
 		return errors.New("invalid username or connection")
 	}
 
+	defer s.flushPresence()
+
 	s.Lock()
 	defer s.Unlock()
 
@@ -373,6 +605,12 @@ func (s *Sockets) AddSession(username string, conn *Connection) error {
 	conn.addSession(newSession)
 	// Add our session to our sockets store
 	s.Sessions[username] = newSession
+	s.config.Metrics.SessionsChanged(len(s.Sessions))
+	s.announceSession(username)
+	// The user is now present in the rooms the connection already joined
+	for _, room := range conn.Rooms() {
+		s.presenceJoin(room, conn)
+	}
 
 	// success
 	return nil
@@ -390,12 +628,14 @@ func (s *Sockets) UpdateSession(username string, conn *Connection) error {
 		return errors.New("invalid username or connection")
 	}
 
+	defer s.flushPresence()
+
 	s.Lock()
 	defer s.Unlock()
 
 	session, exists := s.Sessions[username]
 	if !exists {
-		log.Printf("Failed to update session: No session exists for %s", username)
+		s.config.Logger.Warn("failed to update session: no session exists", conn.logArgs("session", username)...)
 		return errors.New("no session exists for this user")
 	}
 
@@ -403,8 +643,13 @@ func (s *Sockets) UpdateSession(username string, conn *Connection) error {
 	session.addConnection(conn)
 	// Add our session to our connection
 	conn.addSession(session)
+	s.announceSession(username)
+	// The user is now present in the rooms the connection already joined
+	for _, room := range conn.Rooms() {
+		s.presenceJoin(room, conn)
+	}
 
-	log.Printf("Session updated for user: %s", username)
+	s.config.Logger.Debug("session updated", conn.logArgs()...)
 	// success
 	return nil
 }
@@ -414,16 +659,26 @@ func (s *Sockets) DeleteSession(username string) error {
 		return errors.New("invalid username")
 	}
 
+	defer s.flushPresence()
+
 	s.Lock()
 	defer s.Unlock()
 
-	if _, exists := s.Sessions[username]; !exists {
-		log.Printf("Failed to delete session: No session exists for %s", username)
+	session, exists := s.Sessions[username]
+	if !exists {
+		s.config.Logger.Warn("failed to delete session: no session exists", "username", username)
 		return errors.New("no session exists for this user")
 	}
 
+	// The user is no longer present in the rooms its connections are in
+	for _, conn := range session.connections {
+		s.presenceLeaveAll(conn)
+	}
 	delete(s.Sessions, username)
-	log.Printf("Session deleted for user: %s", username)
+	s.userLimits.remove(username)
+	s.config.Metrics.SessionsChanged(len(s.Sessions))
+	s.announceSession(username)
+	s.config.Logger.Debug("session deleted", "username", username)
 
 	return nil
 }
@@ -431,7 +686,7 @@ func (s *Sockets) DeleteSession(username string) error {
 func (s *Sockets) closeWS(conn *Connection) {
 	// Check if the connection is non-nil
 	if conn == nil {
-		log.Println("Attempted to close a nil connection")
+		s.config.Logger.Error("attempted to close a nil connection")
 		return
 	}
 
@@ -440,10 +695,13 @@ func (s *Sockets) closeWS(conn *Connection) {
 		Connection: conn,
 		UUID:       conn.UUID,
 	})
+	s.config.Metrics.ConnectionClosed()
 
-	// Attempt to close the WebSocket connection
+	// Stop the write pump and close the WebSocket connection
+	s.stopExpiry(conn)
+	conn.close()
 	if err := conn.Conn.Close(); err != nil {
-		log.Printf("Error closing WebSocket connection for UUID %s: %v", conn.UUID, err)
+		s.config.Logger.Debug("error closing websocket connection", conn.logArgs("error", err)...)
 	}
 
 	// Safely manage the session and connection removal
@@ -0,0 +1,78 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+type testHandler struct {
+	opened chan *Context
+	closed chan *Context
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{
+		opened: make(chan *Context, 16),
+		closed: make(chan *Context, 16),
+	}
+}
+
+func (h *testHandler) NewConnection(ctx *Context) {
+	h.opened <- ctx
+}
+
+func (h *testHandler) ConnectionClosed(ctx *Context) {
+	h.closed <- ctx
+}
+
+// newTestServer starts a Sockets instance behind an httptest server and
+// returns its websocket URL.
+func newTestServer(t *testing.T, config *Config) (*Sockets, *testHandler, string) {
+	t.Helper()
+	handler := newTestHandler()
+	s := New(handler, config)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.HandleConnection(w, r, "127.0.0.1")
+	}))
+	t.Cleanup(func() {
+		s.Close()
+		srv.Close()
+	})
+	return s, handler, "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+}
+
+func dialTestServer(t *testing.T, url string) *websocket.Conn {
+	t.Helper()
+	ws, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
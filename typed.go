@@ -0,0 +1,73 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import "github.com/syleron/sockets/common"
+
+// On registers a handler receiving the payload of event decoded into T with
+// the connection's codec. Malformed payloads are rejected with a
+// common.CodeBadRequest error. A non-nil error returned by handler is sent
+// back with ReplyError. Middleware such as RequireSession wraps handler.
+func On[T any](s *Sockets, event string, handler func(ctx *Context, payload T) error, middleware ...Middleware) {
+	s.HandleEvent(event, func(msg *common.Message, ctx *Context) {
+		payload, ok := decodePayload[T](msg, ctx)
+		if !ok {
+			return
+		}
+		if err := handler(ctx, payload); err != nil {
+			ctx.ReplyError(err)
+		}
+	}, false, middleware...)
+}
+
+// OnRequest is like On for handlers that answer with a response, which is
+// sent back with Reply unless handler returned an error.
+func OnRequest[T, R any](s *Sockets, event string, handler func(ctx *Context, payload T) (R, error), middleware ...Middleware) {
+	s.HandleEvent(event, func(msg *common.Message, ctx *Context) {
+		payload, ok := decodePayload[T](msg, ctx)
+		if !ok {
+			return
+		}
+		res, err := handler(ctx, payload)
+		if err != nil {
+			ctx.ReplyError(err)
+			return
+		}
+		ctx.Reply(res)
+	}, false, middleware...)
+}
+
+// decodePayload decodes the data of msg, replying with an error when it
+// doesn't fit T. Messages without data leave the payload at its zero value.
+func decodePayload[T any](msg *common.Message, ctx *Context) (T, bool) {
+	var payload T
+	if len(msg.Data) == 0 {
+		return payload, true
+	}
+	if err := ctx.Decode(&payload); err != nil {
+		ctx.logger().Debug("failed to decode payload", ctx.logArgs("event", msg.EventName, "error", err)...)
+		ctx.ReplyError(&common.Error{Code: common.CodeBadRequest, Message: "malformed payload: " + err.Error()})
+		return payload, false
+	}
+	return payload, true
+}
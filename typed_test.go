@@ -0,0 +1,94 @@
+// MIT License
+//
+// Copyright (c) 2018-2024 Andrew Zak <andrew@linux.com>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in all
+// copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+// SOFTWARE.
+
+package sockets
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/syleron/sockets/common"
+)
+
+type addRequest struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+func TestTypedHandlers(t *testing.T) {
+	s, handler, url := newTestServer(t, &Config{})
+	OnRequest(s, "add", func(ctx *Context, req addRequest) (int, error) {
+		if req.A < 0 {
+			return 0, errors.New("negative")
+		}
+		return req.A + req.B, nil
+	})
+	On(s, "greet", func(ctx *Context, name string) error {
+		return &common.Error{Code: "greeted", Message: "hello " + name}
+	})
+	On(s, "private", func(ctx *Context, name string) error {
+		return ctx.Reply("secret")
+	}, RequireSession())
+
+	tests := []struct {
+		name  string
+		event string
+		data  string
+		reply string
+		code  string
+	}{
+		{name: "reply", event: "add", data: `{"a":2,"b":3}`, reply: "5"},
+		{name: "no data", event: "add", reply: "0"},
+		{name: "handler error", event: "add", data: `{"a":-1}`, code: common.CodeHandler},
+		{name: "malformed payload", event: "add", data: `"two"`, code: common.CodeBadRequest},
+		{name: "custom error", event: "greet", data: `"bob"`, code: "greeted"},
+		{name: "session required", event: "private", data: `"bob"`, code: common.CodeUnauthorized},
+	}
+
+	ws := dialTestServer(t, url)
+	<-handler.opened
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := common.Message{EventName: tt.event, ID: tt.name}
+			if tt.data != "" {
+				msg.Data = json.RawMessage(tt.data)
+			}
+			if err := ws.WriteJSON(msg); err != nil {
+				t.Fatal(err)
+			}
+			msg = readMessage(t, ws)
+			if msg.ReplyTo != tt.name {
+				t.Fatalf("got a reply to %q, want %q", msg.ReplyTo, tt.name)
+			}
+			if tt.code != "" {
+				if msg.EventName != common.ErrorEvent || msg.Error == nil || msg.Error.Code != tt.code {
+					t.Fatalf("got %s %+v, want a %s error", msg.EventName, msg.Error, tt.code)
+				}
+				return
+			}
+			if msg.EventName != tt.event || string(msg.Data) != tt.reply {
+				t.Fatalf("got %s %s, want %s %s", msg.EventName, msg.Data, tt.event, tt.reply)
+			}
+		})
+	}
+}
@@ -25,18 +25,18 @@ package sockets
 import (
 	"crypto/x509"
 	"github.com/gorilla/websocket"
-	"log"
+	"github.com/syleron/sockets/common"
 	"net"
 	"net/http"
 )
 
 // determineRealIP returns the real IP of the client
-func determineRealIP(ws *websocket.Conn, realIP string) string {
+func determineRealIP(ws *websocket.Conn, realIP string, logger common.Logger) string {
 	if realIP == "" {
 		return ws.RemoteAddr().String()
 	}
 	if net.ParseIP(realIP) == nil {
-		log.Printf("Invalid realIP provided: %s", realIP)
+		logger.Warn("invalid real ip provided", "real_ip", realIP, "remote_ip", ws.RemoteAddr().String())
 		return ws.RemoteAddr().String() // Fallback to the connection's remote address
 	}
 	return realIP